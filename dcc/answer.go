@@ -0,0 +1,147 @@
+package dcc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// FailedAVP is an AVP the peer copied into the Failed-AVP of an answer: the
+// one it rejected or, for a missing AVP, an example of it. Name is empty when
+// the dictionary does not know the AVP, which is always the case for an AVP
+// with a Vendor-Id: the go-diameter dictionaries only name base AVPs.
+type FailedAVP struct {
+	Code     uint32
+	VendorID uint32
+	Name     string
+	Value    datatype.Type
+}
+
+func (a FailedAVP) String() string {
+	name := a.Name
+	if name == "" {
+		name = fmt.Sprintf("AVP %d", a.Code)
+	}
+	if a.VendorID != 0 {
+		name += fmt.Sprintf(" of vendor %d", a.VendorID)
+	}
+	if a.Value == nil || a.Value.Len() == 0 {
+		return name
+	}
+	return name + " = " + formatValue(a.Value)
+}
+
+// AnswerError is the cause of a request answered with a permanent failure,
+// a 5xxx Result-Code or Experimental-Result-Code. It holds what the peer
+// said about the failure in the Error-Message, Error-Reporting-Host and
+// Failed-AVP AVPs of the answer. Like a ResultError, it matches the sentinel
+// errors of its Result.
+type AnswerError struct {
+	Command            Command
+	Result             Result
+	ErrorMessage       string
+	ErrorReportingHost string
+	FailedAVP          []FailedAVP
+	Answer             *diam.Message
+}
+
+func (e *AnswerError) Error() string {
+	s := fmt.Sprintf("dcc: answer for command %d of application %d has %s", e.Command.Code, e.Command.ApplicationID, e.Result)
+	if e.ErrorMessage != "" {
+		s += ": " + e.ErrorMessage
+	}
+	if len(e.FailedAVP) > 0 {
+		failed := make([]string, len(e.FailedAVP))
+		for i, a := range e.FailedAVP {
+			failed[i] = a.String()
+		}
+		s += " (failed AVP: " + strings.Join(failed, ", ") + ")"
+	}
+	return s
+}
+
+func (e *AnswerError) Is(target error) bool {
+	return e.Result.is(target)
+}
+
+// answerError returns the *AnswerError of an answer with a permanent
+// failure, and nil for any other answer.
+func answerError(dp *dict.Parser, m *diam.Message) *AnswerError {
+	result, _ := ResultOf(m)
+	if result.Class() != ResultPermanentFailure {
+		return nil
+	}
+	e := &AnswerError{
+		Command: Command{ApplicationID: m.Header.ApplicationID, Code: m.Header.CommandCode},
+		Result:  result,
+		Answer:  m,
+	}
+	for _, a := range m.AVP {
+		if a.VendorID != 0 {
+			continue
+		}
+		switch a.Code {
+		case avp.ErrorMessage:
+			if s, ok := a.Data.(datatype.UTF8String); ok {
+				e.ErrorMessage = string(s)
+			}
+		case avp.ErrorReportingHost:
+			if s, ok := a.Data.(datatype.DiameterIdentity); ok {
+				e.ErrorReportingHost = string(s)
+			}
+		case avp.FailedAVP:
+			group, ok := a.Data.(*diam.GroupedAVP)
+			if !ok {
+				continue
+			}
+			for _, failed := range group.AVP {
+				f := FailedAVP{Code: failed.Code, VendorID: failed.VendorID, Value: failed.Data}
+				// A vendor AVP only shares its code with the base AVP the
+				// dictionary names.
+				if failed.VendorID == 0 {
+					if data, err := dp.FindAVP(m.Header.ApplicationID, failed.Code); err == nil {
+						f.Name = data.Name
+					}
+				}
+				e.FailedAVP = append(e.FailedAVP, f)
+			}
+		}
+	}
+	return e
+}
+
+// formatValue formats the data of an AVP without the type name and padding
+// that the String methods of go-diameter add.
+func formatValue(v datatype.Type) string {
+	switch v := v.(type) {
+	case datatype.UTF8String:
+		return string(v)
+	case datatype.DiameterIdentity:
+		return string(v)
+	case datatype.DiameterURI:
+		return string(v)
+	case datatype.OctetString:
+		return fmt.Sprintf("%x", string(v))
+	case datatype.Unsigned32:
+		return fmt.Sprint(uint32(v))
+	case datatype.Unsigned64:
+		return fmt.Sprint(uint64(v))
+	case datatype.Integer32:
+		return fmt.Sprint(int32(v))
+	case datatype.Integer64:
+		return fmt.Sprint(int64(v))
+	case datatype.Enumerated:
+		return fmt.Sprint(int32(v))
+	case *diam.GroupedAVP:
+		values := make([]string, len(v.AVP))
+		for i, a := range v.AVP {
+			values[i] = fmt.Sprintf("%d: %s", a.Code, formatValue(a.Data))
+		}
+		return "{" + strings.Join(values, ", ") + "}"
+	}
+	return v.String()
+}
@@ -0,0 +1,167 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// answerCCR answers CCRs with the given Result-Code and AVPs, followed by
+// the Session-Id and Origin AVPs of a CCA.
+func answerCCR(code uint32, avps ...*diam.AVP) diam.HandlerFunc {
+	return func(conn diam.Conn, m *diam.Message) {
+		a := m.Answer(code)
+		sessionID, _ := m.FindAVP(avp.SessionID)
+		a.AddAVP(sessionID)
+		a.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+		a.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		for _, avp := range avps {
+			a.AddAVP(avp)
+		}
+		a.WriteTo(conn)
+	}
+}
+
+func failedServiceContextID() []*diam.AVP {
+	return []*diam.AVP{
+		diam.NewAVP(avp.ErrorMessage, 0, 0, datatype.UTF8String("missing Service-Context-Id")),
+		diam.NewAVP(avp.FailedAVP, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("")),
+		}}),
+	}
+}
+
+func TestAnswerError(t *testing.T) {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default).Answer(diam.MissingAVP)
+	for _, a := range failedServiceContextID() {
+		m.AddAVP(a)
+	}
+	m.NewAVP(avp.ErrorReportingHost, 0, 0, datatype.DiameterIdentity("ocs"))
+
+	e := answerError(dict.Default, m)
+	if e == nil {
+		t.Fatal("no error for DIAMETER_MISSING_AVP")
+	}
+	if e.Result.Code != diam.MissingAVP || e.ErrorMessage != "missing Service-Context-Id" || e.ErrorReportingHost != "ocs" {
+		t.Errorf("unexpected error %+v", e)
+	}
+	if len(e.FailedAVP) != 1 || e.FailedAVP[0].Name != "Service-Context-Id" || e.FailedAVP[0].Code != avp.ServiceContextID {
+		t.Errorf("unexpected Failed-AVP %v", e.FailedAVP)
+	}
+	want := "dcc: answer for command 272 of application 4 has Result-Code 5005 (DIAMETER_MISSING_AVP): missing Service-Context-Id (failed AVP: Service-Context-Id)"
+	if e.Error() != want {
+		t.Errorf("error %q, want %q", e.Error(), want)
+	}
+
+	if e := answerError(dict.Default, diam.NewRequest(diam.CreditControl, 4, dict.Default).Answer(diam.Success)); e != nil {
+		t.Errorf("error for DIAMETER_SUCCESS: %v", e)
+	}
+}
+
+func TestAnswerErrorMatchesVendorID(t *testing.T) {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default).Answer(diam.InvalidAVPValue)
+	m.NewAVP(avp.ErrorMessage, avp.Vbit, 10415, datatype.UTF8String("vendor message"))
+	m.NewAVP(avp.FailedAVP, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.ServiceContextID, avp.Mbit|avp.Vbit, 10415, datatype.UTF8String("x")),
+	}})
+
+	e := answerError(dict.Default, m)
+	if e == nil {
+		t.Fatal("no error for DIAMETER_INVALID_AVP_VALUE")
+	}
+	if e.ErrorMessage != "" {
+		t.Errorf("vendor AVP read as Error-Message %q", e.ErrorMessage)
+	}
+	if len(e.FailedAVP) != 1 || e.FailedAVP[0].Name != "" || e.FailedAVP[0].VendorID != 10415 {
+		t.Errorf("unexpected Failed-AVP %v", e.FailedAVP)
+	}
+}
+
+func TestFailedAVPString(t *testing.T) {
+	for _, c := range []struct {
+		avp  FailedAVP
+		want string
+	}{
+		{FailedAVP{Code: 415, Name: "CC-Request-Number", Value: datatype.Unsigned32(7)}, "CC-Request-Number = 7"},
+		{FailedAVP{Code: 1, Name: "User-Name", Value: datatype.UTF8String("")}, "User-Name"},
+		{FailedAVP{Code: 900, VendorID: 10415, Value: datatype.OctetString("\xca\xfe")}, "AVP 900 of vendor 10415 = cafe"},
+	} {
+		if got := c.avp.String(); got != c.want {
+			t.Errorf("%q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestClientValidatesAnswers(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	client.config.ValidateAnswers = true
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mux.Handle("CCR", answerCCR(diam.MissingAVP, failedServiceContextID()...))
+	_, err := client.Do(context.Background(), &mockRequest{})
+	var e *Error
+	var answerErr *AnswerError
+	if !errors.As(err, &e) || e.Kind != KindPeerRejected || !errors.As(err, &answerErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(answerErr.FailedAVP) != 1 || answerErr.FailedAVP[0].Name != "Service-Context-Id" {
+		t.Errorf("unexpected Failed-AVP %v", answerErr.FailedAVP)
+	}
+
+	server.mux.Handle("CCR", answerCCR(diam.Success,
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+		diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+	))
+	_, err = client.Do(context.Background(), &mockRequest{})
+	var verr *ValidationError
+	if !errors.As(err, &e) || e.Kind != KindProtocol || !errors.As(err, &verr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !verr.Answer || len(verr.Violations) != 1 || verr.Violations[0].AVP != "CC-Request-Number" {
+		t.Errorf("unexpected violations %v", verr.Violations)
+	}
+
+	server.mux.Handle("CCR", answerCCR(diam.Success,
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+		diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+		diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(0)),
+	))
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientLogsPermanentFailures(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	logger := &recordingLogger{}
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.Logger = logger
+		c.LogLevel = LogInfo
+	})
+	defer client.Close()
+	server.mux.Handle("CCR", answerCCR(diam.MissingAVP, failedServiceContextID()...))
+
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := logger.find(LogAnswerReceived, CreditControlCommand)
+	var answerErr *AnswerError
+	if !ok || e.Level != LogWarn || !errors.As(e.Err, &answerErr) || answerErr.Result.Code != diam.MissingAVP {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
@@ -0,0 +1,248 @@
+package dcc
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+const relayApplicationID = datatype.Unsigned32(0xffffffff)
+
+// VendorSpecificApplicationID advertises an application defined by a vendor
+// such as 3GPP (10415) or Huawei (2011). Only one of AuthApplicationID and
+// AcctApplicationID should be set.
+type VendorSpecificApplicationID struct {
+	VendorID          datatype.Unsigned32
+	AuthApplicationID datatype.Unsigned32
+	AcctApplicationID datatype.Unsigned32
+}
+
+func (id VendorSpecificApplicationID) avp() *diam.AVP {
+	group := &diam.GroupedAVP{
+		AVP: []*diam.AVP{
+			diam.NewAVP(avp.VendorID, avp.Mbit, 0, id.VendorID),
+		},
+	}
+	if id.AuthApplicationID != 0 {
+		group.AVP = append(group.AVP, diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, id.AuthApplicationID))
+	} else {
+		group.AVP = append(group.AVP, diam.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, id.AcctApplicationID))
+	}
+	return diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, group)
+}
+
+// PeerCapabilities is what the peer advertised in its CEA.
+type PeerCapabilities struct {
+	OriginHost                   datatype.DiameterIdentity
+	OriginRealm                  datatype.DiameterIdentity
+	HostIPAddresses              []net.IP
+	VendorID                     datatype.Unsigned32
+	ProductName                  datatype.UTF8String
+	FirmwareRevision             datatype.Unsigned32
+	SupportedVendorIDs           []datatype.Unsigned32
+	AuthApplicationIDs           []datatype.Unsigned32
+	AcctApplicationIDs           []datatype.Unsigned32
+	VendorSpecificApplicationIDs []VendorSpecificApplicationID
+}
+
+// CapabilitiesError is returned when the capabilities exchange fails, either
+// because the CEA carries a failure Result-Code or because the peer does not
+// advertise any application we support.
+type CapabilitiesError struct {
+	ResultCode   uint32
+	ErrorMessage string
+}
+
+func (e *CapabilitiesError) Error() string {
+	if e.ErrorMessage != "" {
+		return fmt.Sprintf("dcc: capabilities exchange failed with Result-Code %d: %s", e.ResultCode, e.ErrorMessage)
+	}
+	return fmt.Sprintf("dcc: capabilities exchange failed with Result-Code %d", e.ResultCode)
+}
+
+// Is matches the sentinel errors of the Result-Code, such as
+// ErrNoCommonApplication.
+func (e *CapabilitiesError) Is(target error) bool {
+	return Result{Code: e.ResultCode}.is(target)
+}
+
+func (e *CapabilitiesError) NoCommonApplication() bool {
+	return e.ResultCode == diam.NoCommonApplication
+}
+
+func (d *diameterClient) PeerCapabilities() PeerCapabilities {
+	d.peerMu.RLock()
+	defer d.peerMu.RUnlock()
+	return d.peer
+}
+
+// localApplications returns the applications advertised in the CER. When
+// none are configured the client advertises Diameter Credit-Control (4).
+func (d *diameterClient) localApplications() (auth, acct []datatype.Unsigned32, vendorSpecific []VendorSpecificApplicationID) {
+	auth = d.config.AuthApplicationIDs
+	acct = d.config.AcctApplicationIDs
+	vendorSpecific = d.config.VendorSpecificApplicationIDs
+	if len(auth) == 0 && len(acct) == 0 && len(vendorSpecific) == 0 {
+		return []datatype.Unsigned32{4}, []datatype.Unsigned32{4}, nil
+	}
+	return auth, acct, vendorSpecific
+}
+
+// localApplicationIDs flattens the applications advertised in the CER.
+func (d *diameterClient) localApplicationIDs() (auth, acct []datatype.Unsigned32) {
+	auth, acct, vendorSpecific := d.localApplications()
+	local := PeerCapabilities{
+		AuthApplicationIDs:           auth,
+		AcctApplicationIDs:           acct,
+		VendorSpecificApplicationIDs: vendorSpecific,
+	}
+	return local.applications()
+}
+
+// supportsApplication reports whether the client takes requests for
+// applicationID: the base protocol or one of the advertised applications.
+func (d *diameterClient) supportsApplication(applicationID uint32) bool {
+	if applicationID == 0 {
+		return true
+	}
+	auth, acct := d.localApplicationIDs()
+	wanted := []datatype.Unsigned32{datatype.Unsigned32(applicationID)}
+	return containsApplication(auth, wanted) || containsApplication(acct, wanted)
+}
+
+func (d *diameterClient) negotiate(m *diam.Message) error {
+	peer, resultCode, errorMessage := parseCEA(m)
+	if resultCode != diam.Success {
+		return &CapabilitiesError{ResultCode: resultCode, ErrorMessage: errorMessage}
+	}
+
+	localAuth, localAcct := d.localApplicationIDs()
+	if !peer.supportsAny(localAuth, localAcct) {
+		return &CapabilitiesError{
+			ResultCode:   diam.NoCommonApplication,
+			ErrorMessage: fmt.Sprintf("peer %s advertises none of our applications", peer.OriginHost),
+		}
+	}
+
+	d.peerMu.Lock()
+	d.peer = peer
+	d.peerMu.Unlock()
+	return nil
+}
+
+// parseCEA reads the base protocol AVPs of a CEA. AVPs of a vendor, or whose
+// data is not of the type of the base AVP, are ignored.
+func parseCEA(m *diam.Message) (peer PeerCapabilities, resultCode uint32, errorMessage string) {
+	for _, a := range m.AVP {
+		if a.VendorID != 0 {
+			continue
+		}
+		switch a.Code {
+		case avp.ResultCode:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				resultCode = uint32(v)
+			}
+		case avp.ErrorMessage:
+			if v, ok := a.Data.(datatype.UTF8String); ok {
+				errorMessage = string(v)
+			}
+		case avp.OriginHost:
+			if v, ok := a.Data.(datatype.DiameterIdentity); ok {
+				peer.OriginHost = v
+			}
+		case avp.OriginRealm:
+			if v, ok := a.Data.(datatype.DiameterIdentity); ok {
+				peer.OriginRealm = v
+			}
+		case avp.HostIPAddress:
+			if v, ok := a.Data.(datatype.Address); ok {
+				peer.HostIPAddresses = append(peer.HostIPAddresses, net.IP(v))
+			}
+		case avp.VendorID:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				peer.VendorID = v
+			}
+		case avp.ProductName:
+			if v, ok := a.Data.(datatype.UTF8String); ok {
+				peer.ProductName = v
+			}
+		case avp.FirmwareRevision:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				peer.FirmwareRevision = v
+			}
+		case avp.SupportedVendorID:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				peer.SupportedVendorIDs = append(peer.SupportedVendorIDs, v)
+			}
+		case avp.AuthApplicationID:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				peer.AuthApplicationIDs = append(peer.AuthApplicationIDs, v)
+			}
+		case avp.AcctApplicationID:
+			if v, ok := a.Data.(datatype.Unsigned32); ok {
+				peer.AcctApplicationIDs = append(peer.AcctApplicationIDs, v)
+			}
+		case avp.VendorSpecificApplicationID:
+			if group, ok := a.Data.(*diam.GroupedAVP); ok {
+				peer.VendorSpecificApplicationIDs = append(peer.VendorSpecificApplicationIDs, parseVendorSpecificApplicationID(group))
+			}
+		}
+	}
+	return peer, resultCode, errorMessage
+}
+
+func parseVendorSpecificApplicationID(group *diam.GroupedAVP) VendorSpecificApplicationID {
+	var id VendorSpecificApplicationID
+	for _, a := range group.AVP {
+		v, ok := a.Data.(datatype.Unsigned32)
+		if a.VendorID != 0 || !ok {
+			continue
+		}
+		switch a.Code {
+		case avp.VendorID:
+			id.VendorID = v
+		case avp.AuthApplicationID:
+			id.AuthApplicationID = v
+		case avp.AcctApplicationID:
+			id.AcctApplicationID = v
+		}
+	}
+	return id
+}
+
+// applications flattens the plain and vendor-specific application IDs.
+func (p PeerCapabilities) applications() (auth, acct []datatype.Unsigned32) {
+	auth = append(auth, p.AuthApplicationIDs...)
+	acct = append(acct, p.AcctApplicationIDs...)
+	for _, id := range p.VendorSpecificApplicationIDs {
+		if id.AuthApplicationID != 0 {
+			auth = append(auth, id.AuthApplicationID)
+		}
+		if id.AcctApplicationID != 0 {
+			acct = append(acct, id.AcctApplicationID)
+		}
+	}
+	return auth, acct
+}
+
+func (p PeerCapabilities) supportsAny(auth, acct []datatype.Unsigned32) bool {
+	peerAuth, peerAcct := p.applications()
+	return containsApplication(peerAuth, auth) || containsApplication(peerAcct, acct)
+}
+
+func containsApplication(advertised, wanted []datatype.Unsigned32) bool {
+	for _, a := range advertised {
+		if a == relayApplicationID {
+			return true
+		}
+		for _, w := range wanted {
+			if a == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package dcc
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+func TestClientRecordsPeerCapabilities(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := client.PeerCapabilities()
+	if peer.OriginHost != "srv" || peer.OriginRealm != "localhost" {
+		t.Errorf("unexpected peer identity %s/%s", peer.OriginHost, peer.OriginRealm)
+	}
+	if len(peer.HostIPAddresses) != 1 || !peer.HostIPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("unexpected Host-IP-Address %v", peer.HostIPAddresses)
+	}
+	if peer.VendorID != 99 || peer.ProductName != "go-diameter" {
+		t.Errorf("unexpected vendor %d product %s", peer.VendorID, peer.ProductName)
+	}
+	if len(peer.AuthApplicationIDs) != 1 || peer.AuthApplicationIDs[0] != 4 {
+		t.Errorf("unexpected Auth-Application-Id %v", peer.AuthApplicationIDs)
+	}
+}
+
+func TestClientInitFailsOnCEAResultCode(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CER", server.HandleCERWith(diam.NoCommonApplication))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err := client.Init()
+	var capErr *CapabilitiesError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("expected *CapabilitiesError, got %v", err)
+	}
+	if !capErr.NoCommonApplication() {
+		t.Errorf("expected DIAMETER_NO_COMMON_APPLICATION, got %d", capErr.ResultCode)
+	}
+}
+
+func TestClientInitFailsWithoutCommonApplication(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CER", server.HandleCERWith(diam.Success,
+		diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415)),
+				diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(16777238)),
+			},
+		}),
+	))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err := client.Init()
+	var capErr *CapabilitiesError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("expected *CapabilitiesError, got %v", err)
+	}
+	if !capErr.NoCommonApplication() {
+		t.Errorf("expected DIAMETER_NO_COMMON_APPLICATION, got %d", capErr.ResultCode)
+	}
+}
+
+func TestClientAcceptsRelayApplication(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CER", server.HandleCERWith(diam.Success,
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, relayApplicationID),
+	))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *Server) HandleCERWith(resultCode uint32, avps ...*diam.AVP) diam.HandlerFunc {
+	return func(conn diam.Conn, m *diam.Message) {
+		s.setConn(conn)
+		answerMessage := m.Answer(resultCode)
+		answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+		answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		answerMessage.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(net.ParseIP("127.0.0.1")))
+		answerMessage.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(99))
+		answerMessage.NewAVP(avp.ProductName, avp.Mbit, 0, datatype.UTF8String("go-diameter"))
+		for _, a := range avps {
+			answerMessage.AddAVP(a)
+		}
+		if _, err := answerMessage.WriteTo(conn); err != nil {
+			s.errorCh <- err
+		}
+	}
+}
+
+func TestClientAdvertisesConfiguredApplications(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	cerCh := make(chan *diam.Message, 1)
+	handleCER := server.HandleCERWith(diam.Success,
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(999)),
+	)
+	server.mux.Handle("CER", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		cerCh <- m
+		handleCER(conn, m)
+	}))
+
+	client := NewTestClient(server.Address)
+	client.config.AuthApplicationIDs = []datatype.Unsigned32{999}
+	client.config.SupportedVendorIDs = []datatype.Unsigned32{2011}
+	client.config.VendorSpecificApplicationIDs = []VendorSpecificApplicationID{
+		{VendorID: 2011, AuthApplicationID: 4},
+	}
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	cer, _, _ := parseCEA(<-cerCh)
+	if len(cer.AuthApplicationIDs) != 1 || cer.AuthApplicationIDs[0] != 999 {
+		t.Errorf("unexpected Auth-Application-Id %v", cer.AuthApplicationIDs)
+	}
+	if len(cer.AcctApplicationIDs) != 0 {
+		t.Errorf("unexpected Acct-Application-Id %v", cer.AcctApplicationIDs)
+	}
+	if len(cer.SupportedVendorIDs) != 1 || cer.SupportedVendorIDs[0] != 2011 {
+		t.Errorf("unexpected Supported-Vendor-Id %v", cer.SupportedVendorIDs)
+	}
+	expected := VendorSpecificApplicationID{VendorID: 2011, AuthApplicationID: 4}
+	if len(cer.VendorSpecificApplicationIDs) != 1 || cer.VendorSpecificApplicationIDs[0] != expected {
+		t.Errorf("unexpected Vendor-Specific-Application-Id %v", cer.VendorSpecificApplicationIDs)
+	}
+}
+
+func TestClientRejectsPeerWithoutConfiguredApplication(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	client.config.AuthApplicationIDs = []datatype.Unsigned32{999}
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err := client.Init()
+	var capErr *CapabilitiesError
+	if !errors.As(err, &capErr) || !capErr.NoCommonApplication() {
+		t.Fatalf("expected DIAMETER_NO_COMMON_APPLICATION, got %v", err)
+	}
+}
+
+func TestParseCEAIgnoresVendorAndMistypedAVPs(t *testing.T) {
+	m := diam.NewMessage(diam.CapabilitiesExchange, 0, 0, 1, 1, nil)
+	m.AddAVP(diam.NewAVP(avp.ResultCode, avp.Mbit, 10415, datatype.OctetString("x")))
+	m.AddAVP(diam.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(diam.Success)))
+	m.AddAVP(diam.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.UTF8String("srv")))
+	m.AddAVP(diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 10415, datatype.Unsigned32(16777238)))
+	m.AddAVP(diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)))
+
+	peer, resultCode, _ := parseCEA(m)
+	if resultCode != diam.Success {
+		t.Errorf("Result-Code %d", resultCode)
+	}
+	if peer.OriginHost != "" {
+		t.Errorf("mistyped Origin-Host read as %q", peer.OriginHost)
+	}
+	if len(peer.AuthApplicationIDs) != 1 || peer.AuthApplicationIDs[0] != 4 {
+		t.Errorf("Auth-Application-Id %v", peer.AuthApplicationIDs)
+	}
+}
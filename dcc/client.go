@@ -1,18 +1,29 @@
 package dcc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/fiorix/go-diameter/diam"
 	"github.com/fiorix/go-diameter/diam/avp"
 	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type diameterClient struct {
+	// cerSentAt and dwrSentAt are accessed atomically and come first to
+	// keep them 64-bit aligned.
+	cerSentAt int64
+	dwrSentAt int64
+
 	config  DiameterConfig
+	connMu  sync.RWMutex
 	conn    diam.Conn
 	handler *diam.ServeMux
 
@@ -20,8 +31,35 @@ type diameterClient struct {
 	ceaCh     chan *diam.Message
 	dwaCh     chan *diam.Message
 	dwAliveCh chan *diam.Message
-	ccaCh     chan *diam.Message
-	inCh      chan Request
+	dpaCh     chan *diam.Message
+	trafficCh chan struct{}
+	stateCh   chan WatchdogState
+	inCh      chan *transaction
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	acceptMu sync.RWMutex
+	closing  bool
+	inflight sync.WaitGroup
+	wg       sync.WaitGroup
+
+	peerMu sync.RWMutex
+	peer   PeerCapabilities
+
+	watchdog *watchdog
+	readyMu  sync.Mutex
+	readyCh  chan struct{}
+
+	ids      *identifiers
+	pending  *pendingTable
+	sessions SessionIDGenerator
+
+	subscribersMu sync.Mutex
+	subscribers   []chan Event
+
+	// failover is set when a Pool owns the client and resends its lost
+	// requests to another peer.
+	failover bool
 }
 
 type DiameterConfig struct {
@@ -33,9 +71,68 @@ type DiameterConfig struct {
 	VendorID         datatype.Unsigned32
 	ProductName      datatype.UTF8String
 	FirmwareRevision datatype.Unsigned32
+
+	AuthApplicationIDs           []datatype.Unsigned32
+	AcctApplicationIDs           []datatype.Unsigned32
+	VendorSpecificApplicationIDs []VendorSpecificApplicationID
+	SupportedVendorIDs           []datatype.Unsigned32
+
+	SessionIDGenerator SessionIDGenerator
+	Dictionary         *dict.Parser
+	TLS                *TLSConfig
+	SessionHandler     SessionHandler
+	ErrorHandler       ErrorHandler
+	Logger             Logger
+	LogLevel           LogLevel
+
 	WatchdogInterval time.Duration
+	TxTimeout        time.Duration
+	// DialTimeout bounds the TCP and TLS handshakes of every connection to
+	// the peer.
+	DialTimeout time.Duration
+
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+	DisconnectCause      datatype.Enumerated
+
+	// ValidateRequests checks every request against the rules of its command
+	// in the Dictionary before it is written. A request that breaks them is
+	// not sent and fails with a *ValidationError.
+	ValidateRequests bool
+	// ValidateAnswers checks every answer against the rules of its command
+	// in the Dictionary. An answer that breaks them fails the request with a
+	// *ValidationError, and one with a permanent failure Result-Code fails
+	// it with an *AnswerError.
+	ValidateAnswers bool
+
+	// Metrics, when set, collects the Prometheus metrics of the client.
+	Metrics *Metrics
+	// Tap, when set, receives every message written to or read from the
+	// peer.
+	Tap Tap
+	// TracerProvider creates the span of every transaction. It defaults to
+	// the global provider of otel.
+	TracerProvider trace.TracerProvider
 }
 
+const (
+	defaultWatchdogInterval     = 30 * time.Second
+	defaultTxTimeout            = 10 * time.Second
+	defaultDialTimeout          = 10 * time.Second
+	defaultReconnectInterval    = time.Second
+	defaultMaxReconnectInterval = 30 * time.Second
+)
+
+var (
+	ErrTxTimeout        = errors.New("dcc: Tx timer expired before the answer arrived")
+	ErrCEATimeout       = errors.New("dcc: no CEA received")
+	ErrConnectionLost   = errors.New("dcc: connection to the peer was lost")
+	ErrPeerSuspect      = errors.New("dcc: peer stopped answering watchdog requests")
+	ErrClientClosed     = errors.New("dcc: client is shut down")
+	ErrHandlerPanic     = errors.New("dcc: panic while handling a message from the peer")
+	ErrMalformedMessage = errors.New("dcc: malformed message from the peer")
+)
+
 func (d *diameterClient) ErrorNotify() <-chan error {
 	return d.errorCh
 }
@@ -52,57 +149,363 @@ func (d *diameterClient) watchdogAliveNotify() <-chan *diam.Message {
 	return d.dwAliveCh
 }
 
-func (d *diameterClient) ccrDoneNotify() <-chan *diam.Message {
-	return d.ccaCh
+func (d *diameterClient) StateNotify() <-chan WatchdogState {
+	return d.stateCh
+}
+
+func (d *diameterClient) WatchdogState() WatchdogState {
+	return d.watchdog.State()
+}
+
+func (d *diameterClient) watchdogInterval() time.Duration {
+	if d.config.WatchdogInterval <= 0 {
+		return defaultWatchdogInterval
+	}
+	return d.config.WatchdogInterval
+}
+
+func (d *diameterClient) txTimeout() time.Duration {
+	if d.config.TxTimeout <= 0 {
+		return defaultTxTimeout
+	}
+	return d.config.TxTimeout
+}
+
+func (d *diameterClient) dialTimeout() time.Duration {
+	if d.config.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return d.config.DialTimeout
+}
+
+func (d *diameterClient) dictionary() *dict.Parser {
+	if d.config.Dictionary == nil {
+		return dict.Default
+	}
+	return d.config.Dictionary
+}
+
+func (d *diameterClient) connection() diam.Conn {
+	d.connMu.RLock()
+	defer d.connMu.RUnlock()
+	return d.conn
+}
+
+func (d *diameterClient) closeNotify() <-chan struct{} {
+	if cn, ok := d.connection().(diam.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+func (d *diameterClient) stop() {
+	d.closeOnce.Do(func() {
+		close(d.closeCh)
+	})
 }
 
 func (d *diameterClient) Close() {
-	d.conn.Close()
+	d.acceptMu.Lock()
+	d.closing = true
+	d.acceptMu.Unlock()
+
+	d.stop()
+	if conn := d.connection(); conn != nil {
+		conn.Close()
+	}
+	d.config.Metrics.remove(d)
 }
 
 func NewClient(config DiameterConfig) *diameterClient {
 	client := &diameterClient{
 		config: config,
 
-		errorCh:   make(chan error),
-		ceaCh:     make(chan *diam.Message),
+		errorCh:   make(chan error, 10),
+		ceaCh:     make(chan *diam.Message, 1),
 		dwaCh:     make(chan *diam.Message),
-		dwAliveCh: make(chan *diam.Message),
-		ccaCh:     make(chan *diam.Message),
-		inCh:      make(chan Request, 10),
+		dwAliveCh: make(chan *diam.Message, 1),
+		dpaCh:     make(chan *diam.Message, 1),
+		trafficCh: make(chan struct{}, 1),
+		stateCh:   make(chan WatchdogState, 10),
+		inCh:      make(chan *transaction, 10),
+		closeCh:   make(chan struct{}),
+
+		watchdog: &watchdog{},
+		readyCh:  make(chan struct{}),
+
+		ids:      newIdentifiers(),
+		pending:  newPendingTable(),
+		sessions: config.SessionIDGenerator,
+	}
+	if client.sessions == nil {
+		client.sessions = NewSessionIDGenerator(config.OriginHost, uint32(time.Now().Unix()), "")
 	}
 	client.handler = diam.NewServeMux()
 	client.handler.Handle("CEA", client.handleCEA())
 	client.handler.Handle("DWA", client.handleDWA())
 	client.handler.Handle("DWR", client.handleDWR())
-	client.handler.Handle("CCA", client.handleCCA())
-
+	client.handler.Handle("CCA", client.handleAnswer())
+	client.handler.Handle("ALL", client.handleUnknown())
+	client.handler.Handle("DPA", client.handleDPA())
+	client.handler.Handle("DPR", client.handleDPR())
+	client.handler.Handle("RAR", client.handleRAR())
+	client.handler.Handle("ASR", client.handleASR())
+
+	config.Metrics.add(client)
 	return client
 }
 
 func (d *diameterClient) Start() error {
-	var err error
-	d.conn, err = diam.Dial(d.config.URL, d.handler, nil)
+	tlsConfig, err := d.tlsConfig()
 	if err != nil {
 		return err
 	}
+	conn, err := dial(d.config.URL, d.dialTimeout(), tlsConfig, d.newConn())
+	if err != nil {
+		return d.newError(KindTransport, Command{}, "", err)
+	}
+	d.connMu.Lock()
+	d.conn = conn
+	d.connMu.Unlock()
 	return nil
 }
 
-func (d *diameterClient) Init() {
-	d.sendCER()
+// newConn returns the peerConn that a new connection is served with.
+func (d *diameterClient) newConn() *peerConn {
+	return &peerConn{
+		handler:   d.handler,
+		dict:      d.dictionary(),
+		tap:       d.config.Tap,
+		recovered: d.recovered,
+		failed:    d.readFailed,
+	}
+}
+
+// recovered reports a panic raised while handling m.
+func (d *diameterClient) recovered(m *diam.Message, v interface{}) {
+	command := Command{ApplicationID: m.Header.ApplicationID, Code: m.Header.CommandCode}
+	d.report(d.newError(KindProtocol, command, "", fmt.Errorf("%w: %v", ErrHandlerPanic, v)))
+}
+
+// readFailed reports why the connection to the peer stopped being read.
+func (d *diameterClient) readFailed(m *diam.Message, err error) {
+	kind := KindTransport
+	var command Command
+	if errors.Is(err, ErrMalformedMessage) {
+		kind = KindProtocol
+	}
+	if m != nil {
+		command = Command{ApplicationID: m.Header.ApplicationID, Code: m.Header.CommandCode}
+	}
+	d.report(d.newError(kind, command, "", err))
+}
+
+func (d *diameterClient) Init() error {
+	if err := d.exchangeCapabilities(); err != nil {
+		return err
+	}
+	d.run()
+	return nil
+}
+
+func (d *diameterClient) run() {
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.loopWatchdog()
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.listen()
+	}()
+}
 
-	<-d.cerDoneNotify()
-	go d.loopWatchdog()
-	go d.listen()
+// keepConnecting retries a failed initial connection in the background with
+// the reconnect backoff and runs the client once the capabilities exchange
+// succeeds.
+func (d *diameterClient) keepConnecting() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if d.reconnect() {
+			d.run()
+		}
+	}()
 }
 
 func (d *diameterClient) loopWatchdog() {
+	timer := time.NewTimer(watchdogTimeout(d.watchdogInterval()))
+	defer timer.Stop()
+
+	state := d.watchdog.State()
+	action := d.watchdog.connectionUp()
+	for {
+		if action&watchdogSendDWR != 0 {
+			d.sendDWR()
+		}
+		if action&watchdogCloseConnection != 0 {
+			d.connection().Close()
+		}
+		if action&watchdogSetTimer != 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(watchdogTimeout(d.watchdogInterval()))
+		}
+
+		if current := d.watchdog.State(); current != state {
+			d.logStateChange(state, current)
+			state = current
+			d.setReady(state == WatchdogOkay)
+			d.notifyState(state)
+			// RFC 3539 section 3.4.1 fails over on the move to SUSPECT: a
+			// peer can stop answering long before its connection is closed.
+			if state == WatchdogSuspect && d.failover {
+				d.pending.failAll(ErrPeerSuspect)
+				d.failQueued(ErrPeerSuspect)
+			}
+		}
+		if state == WatchdogDown {
+			d.pending.failAll(ErrConnectionLost)
+			if d.failover {
+				d.failQueued(ErrConnectionLost)
+			}
+			if !d.reconnect() {
+				return
+			}
+			action = d.watchdog.connectionUp()
+			continue
+		}
+
+		select {
+		case <-d.closeCh:
+			return
+		case <-d.closeNotify():
+			action = d.watchdog.connectionDown()
+		case m := <-d.dwrDoneNotify():
+			action = d.watchdog.receiveDWA()
+			select {
+			case d.dwAliveCh <- m:
+			default:
+			}
+		case <-d.trafficCh:
+			action = d.watchdog.receiveTraffic()
+		case <-timer.C:
+			action = d.watchdog.expire()
+		}
+	}
+}
+
+// failQueued fails the requests that are still waiting to be sent, so that a
+// Pool can move them to another peer instead of waiting for this one.
+func (d *diameterClient) failQueued(err error) {
 	for {
-		d.sendDWR()
+		select {
+		case t := <-d.inCh:
+			t.errorCh <- err
+		default:
+			return
+		}
+	}
+}
+
+func (d *diameterClient) reconnect() bool {
+	interval := d.config.ReconnectInterval
+	if interval <= 0 {
+		interval = defaultReconnectInterval
+	}
+	maxInterval := d.config.MaxReconnectInterval
+	if maxInterval <= 0 {
+		maxInterval = defaultMaxReconnectInterval
+	}
 
-		d.dwAliveCh <- <-d.dwrDoneNotify()
-		time.Sleep(d.config.WatchdogInterval)
+	for {
+		select {
+		case <-d.closeCh:
+			return false
+		case <-time.After(interval):
+		}
+
+		err := d.Start()
+		if err == nil {
+			if err = d.exchangeCapabilities(); err == nil {
+				d.config.Metrics.reconnected(d, true)
+				return true
+			}
+			d.connection().Close()
+		}
+		if err != ErrClientClosed {
+			d.config.Metrics.reconnected(d, false)
+			d.log(LogEntry{Event: LogConnectFailed, Level: LogWarn, Err: err})
+			// Already logged as LogConnectFailed.
+			reportError(d.config.ErrorHandler, d.errorCh, err)
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+func (d *diameterClient) exchangeCapabilities() error {
+	select {
+	case <-d.cerDoneNotify():
+	default:
+	}
+
+	d.sendCER()
+
+	select {
+	case m := <-d.cerDoneNotify():
+		if err := d.negotiate(m); err != nil {
+			return d.newError(KindPeerRejected, capabilitiesExchangeCommand, "", err)
+		}
+		return nil
+	case <-d.closeCh:
+		return ErrClientClosed
+	case <-d.closeNotify():
+		return d.newError(KindTransport, capabilitiesExchangeCommand, "", ErrConnectionLost)
+	case <-time.After(d.txTimeout()):
+		return d.newError(KindTimeout, capabilitiesExchangeCommand, "", ErrCEATimeout)
+	}
+}
+
+func (d *diameterClient) ready() <-chan struct{} {
+	d.readyMu.Lock()
+	defer d.readyMu.Unlock()
+	return d.readyCh
+}
+
+func (d *diameterClient) setReady(ready bool) {
+	d.readyMu.Lock()
+	defer d.readyMu.Unlock()
+	select {
+	case <-d.readyCh:
+		if !ready {
+			d.readyCh = make(chan struct{})
+		}
+	default:
+		if ready {
+			close(d.readyCh)
+		}
+	}
+}
+
+func (d *diameterClient) notifyState(state WatchdogState) {
+	select {
+	case d.stateCh <- state:
+	default:
+	}
+}
+
+func (d *diameterClient) receivedTraffic() {
+	select {
+	case d.trafficCh <- struct{}{}:
+	default:
 	}
 }
 
@@ -114,64 +517,249 @@ type Request interface {
 
 func (d *diameterClient) listen() {
 	for {
-		request := <-d.inCh
-		d.sendCCR(request.AVP())
-		request.Response(<-d.ccrDoneNotify())
+		var t *transaction
+		select {
+		case <-d.closeCh:
+			return
+		case t = <-d.inCh:
+		}
+
+		// A transaction whose caller gave up while it was queued is dropped.
+		expired := time.NewTimer(time.Until(t.deadline))
+		select {
+		case <-d.closeCh:
+			expired.Stop()
+			return
+		case <-t.ctx.Done():
+			expired.Stop()
+			continue
+		case <-expired.C:
+			continue
+		case <-d.ready():
+		}
+		expired.Stop()
+		d.sendRequest(t)
+	}
+}
+
+func (d *diameterClient) Serve(request Request) error {
+	return d.ServeContext(context.Background(), request)
+}
+
+// ServeContext is Serve for a request made on behalf of ctx: the span of the
+// transaction is a child of the span in ctx. Canceling ctx does not cancel
+// the request.
+func (d *diameterClient) ServeContext(ctx context.Context, request Request) error {
+	if !d.accept() {
+		d.config.Metrics.requestFailed(d.config, request, ErrClientClosed)
+		return ErrClientClosed
+	}
+	ctx, end := startSpan(context.WithoutCancel(ctx), d.config, request)
+	t := newTransaction(ctx, request)
+	t.sessionID = d.sessionID(request)
+	t.destinationHost = d.config.DestinationHost
+	err := d.enqueue(t)
+	if err == ErrClientClosed {
+		d.inflight.Done()
+		end(nil, err)
+		d.config.Metrics.requestFailed(d.config, request, err)
+		return err
+	}
+
+	go func() {
+		defer d.inflight.Done()
+		var m *diam.Message
+		if err == nil {
+			m, err = d.wait(t)
+		}
+		end(m, err)
+		if err != nil {
+			d.config.Metrics.requestFailed(d.config, request, err)
+			fail(request, d.config.ErrorHandler, d.errorCh, err)
+			return
+		}
+		request.Response(m)
+	}()
+	return nil
+}
+
+func (d *diameterClient) Do(ctx context.Context, request Request) (*diam.Message, error) {
+	ctx, end := startSpan(ctx, d.config, request)
+	t := newTransaction(ctx, request)
+	t.destinationHost = d.config.DestinationHost
+	m, err := d.do(t)
+	end(m, err)
+	d.config.Metrics.requestFailed(d.config, request, err)
+	return m, err
+}
+
+func (d *diameterClient) do(t *transaction) (*diam.Message, error) {
+	if !d.accept() {
+		return nil, ErrClientClosed
+	}
+	defer d.inflight.Done()
+
+	if t.sessionID == "" {
+		t.sessionID = d.sessionID(t.request)
 	}
+	if err := d.enqueue(t); err != nil {
+		return nil, err
+	}
+	return d.wait(t)
+}
+
+// enqueue starts the Tx timer of t and queues it for listen, unless the timer
+// expires first.
+func (d *diameterClient) enqueue(t *transaction) error {
+	t.deadline = time.Now().Add(d.txTimeout())
+	timer := time.NewTimer(d.txTimeout())
+	defer timer.Stop()
+
+	select {
+	case d.inCh <- t:
+		return nil
+	case <-d.closeCh:
+		return ErrClientClosed
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	case <-timer.C:
+		err := d.newError(KindTimeout, requestCommand(t.request), t.sessionID, ErrTxTimeout)
+		if d.logs(LogWarn) {
+			d.log(LogEntry{Event: LogRequestFailed, Level: LogWarn, Command: requestCommand(t.request), SessionID: t.sessionID, Err: err})
+		}
+		return err
+	}
+}
+
+func (d *diameterClient) accept() bool {
+	d.acceptMu.RLock()
+	defer d.acceptMu.RUnlock()
+	if d.closing {
+		return false
+	}
+	d.inflight.Add(1)
+	return true
 }
 
-func (d *diameterClient) Serve(request Request) {
-	d.inCh <- request
+func (d *diameterClient) wait(t *transaction) (*diam.Message, error) {
+	m, err := d.waitAnswer(t)
+	if err != nil && d.logs(LogWarn) {
+		d.log(LogEntry{Event: LogRequestFailed, Level: LogWarn, Command: requestCommand(t.request), SessionID: t.sessionID, Err: err})
+	}
+	return m, err
+}
+
+func (d *diameterClient) waitAnswer(t *transaction) (*diam.Message, error) {
+	timer := time.NewTimer(time.Until(t.deadline))
+	defer timer.Stop()
+
+	select {
+	case m := <-t.answerNotify():
+		return d.checkAnswer(t, m)
+	case err := <-t.errorNotify():
+		return nil, d.newError(KindTransport, requestCommand(t.request), t.sessionID, err)
+	case <-d.closeCh:
+		d.pending.abandon(t)
+		return nil, ErrClientClosed
+	case <-t.ctx.Done():
+		d.pending.abandon(t)
+		return nil, t.ctx.Err()
+	case <-timer.C:
+		d.pending.abandon(t)
+		return nil, d.newError(KindTimeout, requestCommand(t.request), t.sessionID, ErrTxTimeout)
+	}
+}
+
+// checkAnswer fails the answers ValidateAnswers rejects.
+func (d *diameterClient) checkAnswer(t *transaction, m *diam.Message) (*diam.Message, error) {
+	if !d.config.ValidateAnswers {
+		return m, nil
+	}
+	if err := answerError(d.dictionary(), m); err != nil {
+		return nil, d.newError(KindPeerRejected, requestCommand(t.request), t.sessionID, err)
+	}
+	if err := validateMessage(d.dictionary(), m); err != nil {
+		return nil, d.newError(KindProtocol, requestCommand(t.request), t.sessionID, err)
+	}
+	return m, nil
 }
 
 func (d *diameterClient) sendCER() {
-	m := diam.NewRequest(diam.CapabilitiesExchange, 0, nil)
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, d.dictionary())
 
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
 
-	ip, _, _ := net.SplitHostPort(d.conn.LocalAddr().String())
+	ip, _, _ := net.SplitHostPort(d.connection().LocalAddr().String())
 	m.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(net.ParseIP(ip)))
 	m.NewAVP(avp.VendorID, avp.Mbit, 0, d.config.VendorID)
 	m.NewAVP(avp.ProductName, 0, 0, d.config.ProductName)
 	m.NewAVP(avp.OriginStateID, avp.Mbit, 0, datatype.Unsigned32(0))
-	m.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(0))
-	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4))
-	m.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, datatype.Unsigned32(4))
+	for _, id := range d.config.SupportedVendorIDs {
+		m.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, id)
+	}
+	auth, acct, vendorSpecific := d.localApplications()
+	for _, id := range auth {
+		m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, id)
+	}
+	for _, id := range acct {
+		m.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, id)
+	}
+	for _, id := range vendorSpecific {
+		m.AddAVP(id.avp())
+	}
 	m.NewAVP(avp.FirmwareRevision, avp.Mbit, 0, d.config.FirmwareRevision)
 
-	_, err := m.WriteTo(d.conn)
+	markSent(&d.cerSentAt)
+	conn := d.connection()
+	_, err := m.WriteTo(conn)
+	d.logMessage(LogRequestSent, m, 0, err)
 	if err != nil {
-		d.errorCh <- err
+		d.report(d.newError(KindTransport, capabilitiesExchangeCommand, "", err))
 	}
 }
 
 func (d *diameterClient) handleCEA() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
-		d.ceaCh <- m
+		d.logMessage(LogAnswerReceived, m, sinceSent(&d.cerSentAt), nil)
+		select {
+		case d.ceaCh <- m:
+		default:
+		}
 	}
 }
 
 func (d *diameterClient) sendDWR() {
-	m := diam.NewRequest(diam.DeviceWatchdog, 0, nil)
+	m := diam.NewRequest(diam.DeviceWatchdog, 0, d.dictionary())
 
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
 
-	_, err := m.WriteTo(d.conn)
+	markSent(&d.dwrSentAt)
+	conn := d.connection()
+	_, err := m.WriteTo(conn)
+	d.logMessage(LogRequestSent, m, 0, err)
 	if err != nil {
-		d.errorCh <- err
+		d.report(d.newError(KindTransport, deviceWatchdogCommand, "", err))
 	}
 }
 
 func (d *diameterClient) handleDWA() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
-		d.dwaCh <- m
+		rtt := sinceSent(&d.dwrSentAt)
+		d.logMessage(LogAnswerReceived, m, rtt, nil)
+		d.config.Metrics.watchdogAnswered(d, rtt)
+		select {
+		case d.dwaCh <- m:
+		case <-d.closeCh:
+		}
 	}
 }
 
 func (d *diameterClient) handleDWR() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
+		d.receivedTraffic()
+		d.logMessage(LogRequestReceived, m, 0, nil)
 		answerMessage := m.Answer(diam.Success)
 		d.sendDWA(conn, answerMessage)
 	}
@@ -181,34 +769,116 @@ func (d *diameterClient) sendDWA(w io.Writer, m *diam.Message) {
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
 	_, err := m.WriteTo(w)
+	d.logMessage(LogAnswerSent, m, 0, err)
 
 	if err != nil {
-		d.errorCh <- err
+		d.report(d.newError(KindTransport, deviceWatchdogCommand, "", err))
 	}
 }
 
-func (d *diameterClient) sendCCR(avps []*diam.AVP) {
-	sessionID := fmt.Sprintf("dtac.co.th;OMR%s001", time.Now().Format("20060102150405000"))
+func (d *diameterClient) sendRequest(t *transaction) {
+	key := d.ids.next()
+	var m *diam.Message
+	if t.message != nil {
+		m = retransmission(t, key.hopByHopID)
+		key.endToEndID = m.Header.EndToEndID
+	} else {
+		m = d.newRequest(t, key)
+		if d.config.ValidateRequests {
+			if err := validateMessage(d.dictionary(), m); err != nil {
+				t.errorCh <- d.newError(KindInvalidRequest, requestCommand(t.request), t.sessionID, err)
+				return
+			}
+		}
+	}
+	t.message = m
+	t.sent = time.Now()
+
+	if !d.pending.add(t, key) {
+		return
+	}
+
+	d.traceRequest(t, m)
+	conn := d.connection()
+	_, err := m.WriteTo(conn)
+	d.logMessage(LogRequestSent, m, 0, err)
+	if err == nil {
+		d.config.Metrics.requestSent(d, m)
+		return
+	}
+	// A failed write leaves the stream out of step, so the connection is
+	// dropped and the request fails over like those it had pending.
+	conn.Close()
+	if _, ok := d.pending.remove(key); ok {
+		t.errorCh <- d.newError(KindTransport, requestCommand(t.request), t.sessionID, fmt.Errorf("%w: %v", ErrConnectionLost, err))
+	}
+}
 
-	m := diam.NewRequest(diam.CreditControl, 4, nil)
+func (d *diameterClient) newRequest(t *transaction, key transactionKey) *diam.Message {
+	request := t.request
+	command := requestCommand(request)
+	m := diam.NewMessage(command.Code, diam.RequestFlag, command.ApplicationID, key.hopByHopID, key.endToEndID, d.dictionary())
 
-	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID))
-	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, d.config.DestinationHost)
-	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, d.config.DestinationRealm)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, t.sessionID)
+	if t.destinationHost != "" {
+		m.NewAVP(avp.DestinationHost, avp.Mbit, 0, t.destinationHost)
+	}
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, d.destinationRealm(request))
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
-	for _, avp := range avps {
+	for _, avp := range request.AVP() {
 		m.AddAVP(avp)
 	}
+	return m
+}
 
-	_, err := m.WriteTo(d.conn)
-	if err != nil {
-		d.errorCh <- err
+// retransmission copies a request that was lost with another connection, as
+// described in RFC 6733 section 5.5.4: it keeps the End-to-End identifier and
+// the Session-Id, sets the T flag and is addressed to the Destination-Host of
+// t.
+func retransmission(t *transaction, hopByHopID uint32) *diam.Message {
+	m := t.message
+	flags := m.Header.CommandFlags &^ diam.RetransmittedFlag
+	if t.retransmit {
+		flags |= diam.RetransmittedFlag
+	}
+	r := diam.NewMessage(m.Header.CommandCode, flags, m.Header.ApplicationID, hopByHopID, m.Header.EndToEndID, m.Dictionary())
+	for _, a := range m.AVP {
+		if a.Code == avp.DestinationHost {
+			if t.destinationHost == "" {
+				continue
+			}
+			a = diam.NewAVP(avp.DestinationHost, avp.Mbit, 0, t.destinationHost)
+		}
+		r.AddAVP(a)
 	}
+	return r
 }
 
-func (d *diameterClient) handleCCA() diam.HandlerFunc {
+func (d *diameterClient) handleAnswer() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
-		d.ccaCh <- m
+		if m.Header.CommandFlags&diam.RequestFlag != 0 {
+			return
+		}
+		d.receivedTraffic()
+		if t, ok := d.pending.remove(messageKey(m)); ok {
+			latency := time.Since(t.sent)
+			d.config.Metrics.answerReceived(d, t.message, m, latency)
+			// Permanent failures are logged with what the peer said about
+			// them.
+			var err error
+			if e := answerError(d.dictionary(), m); e != nil {
+				err = e
+			}
+			if e, ok := d.messageEntry(LogAnswerReceived, m, latency, err); ok {
+				// Answers that leave out the Session-Id are still logged
+				// with the one of their request.
+				if e.SessionID == "" {
+					e.SessionID = t.sessionID
+				}
+				d.log(e)
+			}
+			t.answerCh <- m
+		}
 	}
 }
@@ -5,6 +5,7 @@ package dcc
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
@@ -21,23 +22,21 @@ func TestClientIntegration(t *testing.T) {
 	dict.Default.Load(bytes.NewBufferString(dictionary.AppDictionary))
 	dict.Default.Load(bytes.NewBufferString(dictionary.CreditControlDictionary))
 
-	client := NewClient(DiameterConfig{
-		URL:              "10.89.104.33:6553",
-		OriginHost:       datatype.DiameterIdentity("jenkin13_OMR_TEST01"),
-		OriginRealm:      datatype.DiameterIdentity("dtac.co.th"),
-		DestinationHost:  datatype.DiameterIdentity("cbp241"),
-		DestinationRealm: datatype.DiameterIdentity("www.huawei.com"),
-		VendorID:         datatype.Unsigned32(0),
-		ProductName:      datatype.UTF8String("omr"),
-		FirmwareRevision: datatype.Unsigned32(1),
-		WatchdogInterval: 3 * time.Second,
-	})
+	// The peer and identities come from the file named by DCC_CONFIG and the
+	// DCC_ environment variables, such as DCC_URL and DCC_ORIGIN_HOST.
+	config, err := LoadConfig(os.Getenv("DCC_CONFIG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(config.DiameterConfig)
 	if err := client.Start(); err != nil {
 		t.Fatal(err)
 	}
 	defer client.Close()
 
-	client.Init()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
 
 	request := &TestRequest{
 		outCh: make(chan *diam.Message),
@@ -1,7 +1,11 @@
 package dcc
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,10 +17,17 @@ import (
 
 type Server struct {
 	*diamtest.Server
+	mu   sync.Mutex
 	conn diam.Conn
+	mux  *diam.ServeMux
+
+	// writeMu serializes the handlers with messages the test sends on its
+	// own, since diam.Conn writes on the server side are not synchronized.
+	writeMu sync.Mutex
 
 	errorCh chan error
 	dwaCh   chan *diam.Message
+	dprCh   chan *diam.Message
 }
 
 func (s *Server) ErrorNotify() <-chan error {
@@ -27,23 +38,68 @@ func (s *Server) ResponseWatchdogNotify() <-chan *diam.Message {
 	return s.dwaCh
 }
 
+func (s *Server) DisconnectNotify() <-chan *diam.Message {
+	return s.dprCh
+}
+
+func (s *Server) setConn(conn diam.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = conn
+}
+
+func (s *Server) Conn() diam.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
 func NewTestServer() *Server {
+	testServer := newTestServer()
+	testServer.Start()
+	return testServer
+}
+
+// NewTestTLSServer is NewTestServer behind TLS. config must carry the server
+// certificate: diamtest's StartTLS falls back to a 512-bit RSA certificate
+// that current Go versions refuse to load, so the listener is wrapped here.
+func NewTestTLSServer(config *tls.Config) *Server {
+	testServer := newTestServer()
+	testServer.TLS = config
+	testServer.Listener = tls.NewListener(testServer.Listener, config)
+	testServer.Start()
+	return testServer
+}
+
+func newTestServer() *Server {
 	testServer := &Server{
 		errorCh: make(chan error),
 		dwaCh:   make(chan *diam.Message),
+		dprCh:   make(chan *diam.Message, 1),
 	}
 
-	smux := diam.NewServeMux()
-	smux.Handle("CER", testServer.HandleCER())
-	smux.Handle("DWR", testServer.HandleDWR())
-	smux.Handle("DWA", testServer.HandleDWA())
-	smux.Handle("CCR", testServer.HandleCCR())
+	testServer.mux = diam.NewServeMux()
+	testServer.mux.Handle("CER", testServer.HandleCER())
+	testServer.mux.Handle("DWR", testServer.HandleDWR())
+	testServer.mux.Handle("DWA", testServer.HandleDWA())
+	testServer.mux.Handle("CCR", testServer.HandleCCR())
+	testServer.mux.Handle("DPR", testServer.HandleDPR())
 
-	testServer.Server = diamtest.NewServer(smux, nil)
+	testServer.Server = diamtest.NewUnstartedServer(testServer, nil)
 
 	return testServer
 }
 
+func (s *Server) ServeDIAM(conn diam.Conn, m *diam.Message) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mux.ServeDIAM(conn, m)
+}
+
+func (s *Server) ErrorReports() chan diam.ErrorReport {
+	return s.mux.ErrorReports()
+}
+
 func NewTestClient(address string) *diameterClient {
 	return NewClient(DiameterConfig{
 		URL:              address,
@@ -55,9 +111,31 @@ func NewTestClient(address string) *diameterClient {
 		ProductName:      datatype.UTF8String("go-diameter"),
 		FirmwareRevision: datatype.Unsigned32(1),
 		WatchdogInterval: 100 * time.Millisecond,
+
+		ReconnectInterval:    10 * time.Millisecond,
+		MaxReconnectInterval: 100 * time.Millisecond,
 	})
 }
 
+// startTestClient starts a client of server, with its configuration changed
+// by configure if set, and waits for the capabilities exchange and the
+// watchdog to bring it to OKAY.
+func startTestClient(t *testing.T, server *Server, configure func(*DiameterConfig)) *diameterClient {
+	client := NewTestClient(server.Address)
+	if configure != nil {
+		configure(&client.config)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Init(); err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	waitForState(t, client, WatchdogOkay)
+	return client
+}
+
 func TestClientRequestCER(t *testing.T) {
 	server := NewTestServer()
 	defer server.Close()
@@ -83,7 +161,7 @@ func TestClientRequestCER(t *testing.T) {
 
 func (s *Server) HandleCER() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
-		s.conn = conn
+		s.setConn(conn)
 		answerMessage := m.Answer(diam.Success)
 		s.SendCEA(answerMessage)
 	}
@@ -95,7 +173,8 @@ func (s *Server) SendCEA(m *diam.Message) {
 	m.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(net.ParseIP("127.0.0.1")))
 	m.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(99))
 	m.NewAVP(avp.ProductName, avp.Mbit, 0, datatype.UTF8String("go-diameter"))
-	_, err := m.WriteTo(s.conn)
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4))
+	_, err := m.WriteTo(s.Conn())
 	if err != nil {
 		s.errorCh <- err
 	}
@@ -126,7 +205,7 @@ func TestClientRequestDWR(t *testing.T) {
 
 func (s *Server) HandleDWR() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
-		s.conn = conn
+		s.setConn(conn)
 		answerMessage := m.Answer(diam.Success)
 		s.SendDWA(answerMessage)
 	}
@@ -135,7 +214,7 @@ func (s *Server) HandleDWR() diam.HandlerFunc {
 func (s *Server) SendDWA(m *diam.Message) {
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.OctetString("srv"))
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.OctetString("localhost"))
-	_, err := m.WriteTo(s.conn)
+	_, err := m.WriteTo(s.Conn())
 	if err != nil {
 		s.errorCh <- err
 	}
@@ -151,14 +230,16 @@ func TestClientHandshakeAndRequestWatchdog(t *testing.T) {
 	}
 	defer client.Close()
 
-	client.Init()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
 
 	select {
 	case err := <-server.ErrorNotify():
 		t.Error(err)
 	case err := <-client.ErrorNotify():
 		t.Error(err)
-	case <-client.dwrDoneNotify():
+	case <-client.watchdogAliveNotify():
 	case <-time.After(time.Second):
 		t.Error("timeout")
 	}
@@ -231,7 +312,9 @@ func (s *Server) SendDWR() {
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
 
-	_, err := m.WriteTo(s.conn)
+	s.writeMu.Lock()
+	_, err := m.WriteTo(s.Conn())
+	s.writeMu.Unlock()
 
 	if err != nil {
 		s.errorCh <- err
@@ -244,6 +327,18 @@ func (s *Server) HandleDWA() diam.HandlerFunc {
 	}
 }
 
+func (s *Server) HandleDPR() diam.HandlerFunc {
+	return func(conn diam.Conn, m *diam.Message) {
+		s.dprCh <- m
+		answerMessage := m.Answer(diam.Success)
+		answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+		answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		if _, err := answerMessage.WriteTo(conn); err != nil {
+			s.errorCh <- err
+		}
+	}
+}
+
 func TestClientCallCCR(t *testing.T) {
 	server := NewTestServer()
 	defer server.Close()
@@ -254,32 +349,56 @@ func TestClientCallCCR(t *testing.T) {
 	}
 	defer client.Close()
 
-	client.sendCCR([]*diam.AVP{})
+	tx := newTransaction(context.Background(), &mockRequest{})
+	client.sendRequest(tx)
 
 	select {
 	case err := <-server.ErrorNotify():
 		t.Error(err)
-	case err := <-client.ErrorNotify():
+	case err := <-tx.errorNotify():
 		t.Error(err)
-	case <-client.ccrDoneNotify():
+	case <-tx.answerNotify():
 	case <-time.After(time.Second):
 		t.Error("server timeout")
 	}
+
+	if n := client.pending.len(); n != 0 {
+		t.Errorf("%d transactions still pending", n)
+	}
 }
 
 func (s *Server) HandleCCR() diam.HandlerFunc {
 	return func(conn diam.Conn, m *diam.Message) {
-		s.conn = conn
+		s.setConn(conn)
 		answerMessage := m.Answer(diam.Success)
 		s.SendCCA(answerMessage)
 	}
 }
 
+func (s *Server) HandleCCRInReverse(n int) diam.HandlerFunc {
+	var held []*diam.Message
+	return func(conn diam.Conn, m *diam.Message) {
+		s.setConn(conn)
+		held = append(held, m)
+		if len(held) < n {
+			return
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			answerMessage := held[i].Answer(diam.Success)
+			if number, err := held[i].FindAVP(avp.CCRequestNumber); err == nil {
+				answerMessage.AddAVP(number)
+			}
+			s.SendCCA(answerMessage)
+		}
+		held = nil
+	}
+}
+
 func (s *Server) SendCCA(m *diam.Message) {
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
 	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
 
-	_, err := m.WriteTo(s.conn)
+	_, err := m.WriteTo(s.Conn())
 	if err != nil {
 		s.errorCh <- err
 	}
@@ -295,7 +414,9 @@ func TestClientRunBackgroundCCR(t *testing.T) {
 	}
 	defer client.Close()
 
-	client.Init()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
 
 	request := &mockRequest{
 		outCh: make(chan *diam.Message),
@@ -321,6 +442,257 @@ func TestClientRunBackgroundCCR(t *testing.T) {
 	}
 }
 
+func TestClientCorrelatesOutOfOrderCCA(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CCR", server.HandleCCRInReverse(3))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make([]*numberedRequest, 3)
+	for i := range requests {
+		requests[i] = &numberedRequest{
+			mockRequest: mockRequest{outCh: make(chan *diam.Message)},
+			number:      datatype.Unsigned32(i),
+		}
+		client.Serve(requests[i])
+	}
+
+	for _, request := range requests {
+		select {
+		case err := <-server.ErrorNotify():
+			t.Fatal(err)
+		case err := <-client.ErrorNotify():
+			t.Fatal(err)
+		case m := <-request.ResponseNotify():
+			number, err := m.FindAVP(avp.CCRequestNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if number.Data != request.number {
+				t.Errorf("request %d got the answer for request %v", request.number, number.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("server timeout")
+		}
+	}
+}
+
+func TestClientDo(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m, err := client.Do(ctx, &mockRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.CommandCode != diam.CreditControl {
+		t.Errorf("unexpected answer command %d", m.Header.CommandCode)
+	}
+}
+
+func TestClientDoTxTimeout(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+
+	client := NewTestClient(server.Address)
+	client.config.TxTimeout = 50 * time.Millisecond
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do(context.Background(), &mockRequest{}); !errors.Is(err, ErrTxTimeout) {
+		t.Fatalf("expected ErrTxTimeout, got %v", err)
+	}
+	if n := client.pending.len(); n != 0 {
+		t.Errorf("%d transactions still pending", n)
+	}
+}
+
+func TestClientDoTxTimeoutWhilePeerIsDown(t *testing.T) {
+	server := NewTestServer()
+	client := NewTestClient(server.Address)
+	client.config.TxTimeout = 100 * time.Millisecond
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, client, WatchdogOkay)
+	server.Close()
+	server.Conn().Close()
+	waitForState(t, client, WatchdogDown)
+
+	// More requests than the queue holds: the Tx timer bounds those that
+	// wait for a slot too.
+	errCh := make(chan error, 15)
+	for i := 0; i < cap(errCh); i++ {
+		go func() {
+			_, err := client.Do(context.Background(), &mockRequest{})
+			errCh <- err
+		}()
+	}
+	for i := 0; i < cap(errCh); i++ {
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, ErrTxTimeout) {
+				t.Errorf("expected ErrTxTimeout, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d requests still blocked", cap(errCh)-i)
+		}
+	}
+
+	// The expired requests do not stay queued.
+	deadline := time.Now().Add(time.Second)
+	for len(client.inCh) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d expired requests still queued", len(client.inCh))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientDoContextCancelled(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Do(ctx, &mockRequest{}); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := client.pending.len(); n != 0 {
+		t.Errorf("%d transactions still pending", n)
+	}
+}
+
+func TestClientReconnectsAfterConnectionLoss(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, client, WatchdogOkay)
+
+	server.Conn().Close()
+
+	waitForState(t, client, WatchdogDown)
+	waitForState(t, client, WatchdogReopen)
+	waitForState(t, client, WatchdogOkay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := client.Do(ctx, &mockRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientServesQueuedRequestsAfterReconnect(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, client, WatchdogOkay)
+
+	server.Conn().Close()
+	waitForState(t, client, WatchdogDown)
+
+	request := &mockRequest{
+		outCh: make(chan *diam.Message),
+	}
+	client.Serve(request)
+
+	select {
+	case err := <-client.ErrorNotify():
+		t.Fatal(err)
+	case <-request.ResponseNotify():
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued request was not served after reconnect")
+	}
+}
+
+func waitForState(t *testing.T, client *diameterClient, state WatchdogState) {
+	for {
+		select {
+		case s := <-client.StateNotify():
+			if s == state {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", state)
+		}
+	}
+}
+
+type numberedRequest struct {
+	mockRequest
+	number datatype.Unsigned32
+}
+
+func (r *numberedRequest) AVP() []*diam.AVP {
+	return []*diam.AVP{
+		diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, r.number),
+	}
+}
+
 type mockRequest struct {
 	outCh chan *diam.Message
 }
@@ -0,0 +1,82 @@
+package dcc
+
+import (
+	"fmt"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// Command identifies an application request by its Application-Id and
+// Command-Code.
+type Command struct {
+	ApplicationID uint32
+	Code          uint32
+}
+
+var CreditControlCommand = Command{ApplicationID: 4, Code: diam.CreditControl}
+
+// CommandRequest is implemented by requests for any command other than
+// Credit-Control, which is what plain Requests are sent as.
+type CommandRequest interface {
+	Request
+	Command() Command
+}
+
+// FindCommand looks a command up by its name or short name, such as
+// "Hello-Message" or "HM", in the applications loaded into dp.
+func FindCommand(dp *dict.Parser, applicationID uint32, name string) (Command, error) {
+	if dp == nil {
+		dp = dict.Default
+	}
+	for _, app := range dp.Apps() {
+		if app.ID != applicationID {
+			continue
+		}
+		for _, cmd := range app.Command {
+			if cmd.Name == name || cmd.Short == name {
+				return Command{ApplicationID: app.ID, Code: cmd.Code}, nil
+			}
+		}
+	}
+	return Command{}, fmt.Errorf("dcc: command %s not found in application %d", name, applicationID)
+}
+
+func requestCommand(request Request) Command {
+	if r, ok := request.(CommandRequest); ok {
+		return r.Command()
+	}
+	return CreditControlCommand
+}
+
+type commandRequest struct {
+	command Command
+	avps    []*diam.AVP
+	outCh   chan *diam.Message
+}
+
+// NewCommandRequest returns a Request for command carrying avps. Session-Id,
+// Origin and Destination AVPs are added by the client.
+func NewCommandRequest(command Command, avps ...*diam.AVP) *commandRequest {
+	return &commandRequest{
+		command: command,
+		avps:    avps,
+		outCh:   make(chan *diam.Message, 1),
+	}
+}
+
+func (r *commandRequest) Command() Command {
+	return r.command
+}
+
+func (r *commandRequest) AVP() []*diam.AVP {
+	return r.avps
+}
+
+func (r *commandRequest) Response(m *diam.Message) {
+	r.outCh <- m
+}
+
+func (r *commandRequest) ResponseNotify() <-chan *diam.Message {
+	return r.outCh
+}
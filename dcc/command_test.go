@@ -0,0 +1,106 @@
+package dcc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+
+	"github.com/skyfoxs/diameter-sample/dcc/dictionary"
+)
+
+// The Hello application is loaded before any test runs, since both the
+// client and the test server read dict.Default from their own goroutines.
+func init() {
+	if err := dict.Default.Load(bytes.NewBufferString(dictionary.HelloDictionary)); err != nil {
+		panic(err)
+	}
+}
+
+func helloCommand(t *testing.T) Command {
+	command, err := FindCommand(nil, 999, "Hello-Message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestFindCommand(t *testing.T) {
+	command := helloCommand(t)
+	if command != (Command{ApplicationID: 999, Code: 111}) {
+		t.Errorf("unexpected command %+v", command)
+	}
+
+	short, err := FindCommand(nil, 999, "HM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short != command {
+		t.Errorf("short name resolved to %+v", short)
+	}
+
+	if _, err := FindCommand(nil, 999, "Goodbye-Message"); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+	if _, err := FindCommand(nil, 4, "Hello-Message"); err == nil {
+		t.Error("expected an error for a command outside its application")
+	}
+}
+
+func TestClientDoHelloMessage(t *testing.T) {
+	command := helloCommand(t)
+
+	server := NewTestServer()
+	defer server.Close()
+	requestCh := make(chan *diam.Message, 1)
+	server.mux.Handle("HMR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		requestCh <- m
+		answerMessage := m.Answer(diam.Success)
+		if sessionID, err := m.FindAVP(avp.SessionID); err == nil {
+			answerMessage.AddAVP(sessionID)
+		}
+		answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+		answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		answerMessage.WriteTo(conn)
+	}))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := NewCommandRequest(command, diam.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("alice")))
+	answer, err := client.Do(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := <-requestCh
+	if sent.Header.ApplicationID != 999 || sent.Header.CommandCode != 111 {
+		t.Errorf("sent application %d command %d", sent.Header.ApplicationID, sent.Header.CommandCode)
+	}
+	for _, code := range []uint32{avp.SessionID, avp.OriginHost, avp.OriginRealm, avp.DestinationHost, avp.DestinationRealm, avp.UserName} {
+		if _, err := sent.FindAVP(code); err != nil {
+			t.Errorf("request is missing AVP %d", code)
+		}
+	}
+
+	if answer.Header.CommandCode != 111 || answer.Header.HopByHopID != sent.Header.HopByHopID {
+		t.Errorf("answer not correlated: %+v", answer.Header)
+	}
+	resultCode, err := answer.FindAVP(avp.ResultCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resultCode.Data.(datatype.Unsigned32) != diam.Success {
+		t.Errorf("unexpected Result-Code %v", resultCode.Data)
+	}
+}
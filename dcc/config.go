@@ -0,0 +1,490 @@
+package dcc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a configuration loaded by LoadConfig. A single peer is configured
+// with the URL and DestinationHost of DiameterConfig, a group of peers with
+// Peers and Policy, and realm-based routing with Routes.
+type Config struct {
+	DiameterConfig
+	Peers  []PeerConfig
+	Policy BalancePolicy
+	Routes []Route
+}
+
+// PoolConfig returns the Peers of c or, when it has none, its single peer.
+func (c *Config) PoolConfig() PoolConfig {
+	peers := c.Peers
+	if len(peers) == 0 && c.URL != "" {
+		peers = []PeerConfig{{URL: c.URL, DestinationHost: c.DestinationHost}}
+	}
+	return PoolConfig{DiameterConfig: c.DiameterConfig, Peers: peers, Policy: c.Policy}
+}
+
+// RoutingConfig returns the Routes of c or, when it has none, a default route
+// to the peers of PoolConfig.
+func (c *Config) RoutingConfig() RoutingConfig {
+	routes := c.Routes
+	if len(routes) == 0 {
+		pool := c.PoolConfig()
+		routes = []Route{{Peers: pool.Peers, Policy: pool.Policy}}
+	}
+	return RoutingConfig{DiameterConfig: c.DiameterConfig, Routes: routes}
+}
+
+// ConfigError is an invalid field of a configuration. Field is its path, such
+// as "routes[1].peers[0].url".
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("dcc: config field %s: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigEnvPrefix starts the names of the environment variables that
+// override the fields of a configuration file. The rest of the name is the
+// path of the field in upper case, with underscores for dots and indexes:
+// DCC_ORIGIN_HOST, DCC_TLS_CA_FILE or DCC_ROUTES_1_PEERS_0_URL. Lists of
+// numbers, such as DCC_AUTH_APPLICATION_IDS, are separated by commas.
+const ConfigEnvPrefix = "DCC_"
+
+// The file form of Config. Durations are strings such as "30s" and
+// enumerations are lower case names such as "round_robin".
+type fileConfig struct {
+	URL              string `yaml:"url" json:"url"`
+	OriginHost       string `yaml:"origin_host" json:"origin_host"`
+	OriginRealm      string `yaml:"origin_realm" json:"origin_realm"`
+	DestinationHost  string `yaml:"destination_host" json:"destination_host"`
+	DestinationRealm string `yaml:"destination_realm" json:"destination_realm"`
+	VendorID         uint32 `yaml:"vendor_id" json:"vendor_id"`
+	ProductName      string `yaml:"product_name" json:"product_name"`
+	FirmwareRevision uint32 `yaml:"firmware_revision" json:"firmware_revision"`
+
+	AuthApplicationIDs           []uint32                          `yaml:"auth_application_ids" json:"auth_application_ids"`
+	AcctApplicationIDs           []uint32                          `yaml:"acct_application_ids" json:"acct_application_ids"`
+	VendorSpecificApplicationIDs []fileVendorSpecificApplicationID `yaml:"vendor_specific_application_ids" json:"vendor_specific_application_ids"`
+	SupportedVendorIDs           []uint32                          `yaml:"supported_vendor_ids" json:"supported_vendor_ids"`
+
+	TLS *fileTLSConfig `yaml:"tls" json:"tls"`
+
+	WatchdogInterval     string `yaml:"watchdog_interval" json:"watchdog_interval"`
+	TxTimeout            string `yaml:"tx_timeout" json:"tx_timeout"`
+	DialTimeout          string `yaml:"dial_timeout" json:"dial_timeout"`
+	ReconnectInterval    string `yaml:"reconnect_interval" json:"reconnect_interval"`
+	MaxReconnectInterval string `yaml:"max_reconnect_interval" json:"max_reconnect_interval"`
+	DisconnectCause      string `yaml:"disconnect_cause" json:"disconnect_cause"`
+
+	ValidateRequests bool   `yaml:"validate_requests" json:"validate_requests"`
+	ValidateAnswers  bool   `yaml:"validate_answers" json:"validate_answers"`
+	LogLevel         string `yaml:"log_level" json:"log_level"`
+
+	Peers  []filePeerConfig `yaml:"peers" json:"peers"`
+	Policy string           `yaml:"policy" json:"policy"`
+	Routes []fileRoute      `yaml:"routes" json:"routes"`
+}
+
+type fileVendorSpecificApplicationID struct {
+	VendorID          uint32 `yaml:"vendor_id" json:"vendor_id"`
+	AuthApplicationID uint32 `yaml:"auth_application_id" json:"auth_application_id"`
+	AcctApplicationID uint32 `yaml:"acct_application_id" json:"acct_application_id"`
+}
+
+type fileTLSConfig struct {
+	CAFile     string `yaml:"ca_file" json:"ca_file"`
+	CertFile   string `yaml:"cert_file" json:"cert_file"`
+	KeyFile    string `yaml:"key_file" json:"key_file"`
+	ServerName string `yaml:"server_name" json:"server_name"`
+	MinVersion string `yaml:"min_version" json:"min_version"`
+}
+
+type filePeerConfig struct {
+	URL             string `yaml:"url" json:"url"`
+	DestinationHost string `yaml:"destination_host" json:"destination_host"`
+	Weight          int    `yaml:"weight" json:"weight"`
+	Priority        int    `yaml:"priority" json:"priority"`
+}
+
+type fileRoute struct {
+	Realm         string           `yaml:"realm" json:"realm"`
+	ApplicationID uint32           `yaml:"application_id" json:"application_id"`
+	Action        string           `yaml:"action" json:"action"`
+	Peers         []filePeerConfig `yaml:"peers" json:"peers"`
+	Policy        string           `yaml:"policy" json:"policy"`
+}
+
+// LoadConfig reads a YAML or JSON configuration file, JSON being picked by
+// the .json extension, and applies the overrides of the environment
+// variables named after ConfigEnvPrefix. An empty path loads the
+// configuration from the environment alone. Every field is checked before
+// LoadConfig returns; the error joins a *ConfigError for each invalid field.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, os.Environ())
+}
+
+func loadConfig(path string, environ []string) (*Config, error) {
+	var f fileConfig
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeConfig(b, strings.EqualFold(filepath.Ext(path), ".json"), &f); err != nil {
+			return nil, fmt.Errorf("dcc: config %s: %w", path, err)
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.HasPrefix(kv, ConfigEnvPrefix) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	var errs []error
+	applyEnv(reflect.ValueOf(&f).Elem(), strings.TrimSuffix(ConfigEnvPrefix, "_"), "", env, &errs)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	c := f.config(&errs)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+func decodeConfig(b []byte, isJSON bool, f *fileConfig) error {
+	if isJSON {
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		return d.Decode(f)
+	}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(f); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// applyEnv sets the fields of v that have an environment variable. Lists of
+// structs grow to the highest index named by a variable.
+func applyEnv(v reflect.Value, name, path string, env map[string]string, errs *[]error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("yaml")
+		fieldName := name + "_" + strings.ToUpper(tag)
+		fieldPath := tag
+		if path != "" {
+			fieldPath = path + "." + tag
+		}
+		field := v.Field(i)
+
+		switch {
+		case field.Kind() == reflect.Ptr:
+			if field.IsNil() && !hasEnvPrefix(env, fieldName+"_") {
+				continue
+			}
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			applyEnv(field.Elem(), fieldName, fieldPath, env, errs)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < field.Len() || hasEnvPrefix(env, fmt.Sprintf("%s_%d_", fieldName, j)); j++ {
+				if j == field.Len() {
+					field.Set(reflect.Append(field, reflect.New(field.Type().Elem()).Elem()))
+				}
+				applyEnv(field.Index(j), fmt.Sprintf("%s_%d", fieldName, j), fmt.Sprintf("%s[%d]", fieldPath, j), env, errs)
+			}
+		default:
+			s, ok := env[fieldName]
+			if !ok {
+				continue
+			}
+			if err := setEnvValue(field, s); err != nil {
+				*errs = append(*errs, &ConfigError{Field: fieldPath, Err: fmt.Errorf("%s: %v", fieldName, err)})
+			}
+		}
+	}
+}
+
+func hasEnvPrefix(env map[string]string, prefix string) bool {
+	for name := range env {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setEnvValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(s, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint32:
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := setEnvValue(e, item); err != nil {
+				return err
+			}
+			list = reflect.Append(list, e)
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// config converts f and appends the errors of its invalid fields to errs.
+func (f *fileConfig) config(errs *[]error) *Config {
+	invalid := func(field string, format string, args ...interface{}) {
+		*errs = append(*errs, &ConfigError{Field: field, Err: fmt.Errorf(format, args...)})
+	}
+
+	c := &Config{DiameterConfig: DiameterConfig{
+		URL:              f.URL,
+		OriginHost:       identity("origin_host", f.OriginHost, true, invalid),
+		OriginRealm:      identity("origin_realm", f.OriginRealm, true, invalid),
+		DestinationHost:  identity("destination_host", f.DestinationHost, false, invalid),
+		DestinationRealm: identity("destination_realm", f.DestinationRealm, len(f.Routes) == 0, invalid),
+		VendorID:         datatype.Unsigned32(f.VendorID),
+		ProductName:      datatype.UTF8String(f.ProductName),
+		FirmwareRevision: datatype.Unsigned32(f.FirmwareRevision),
+
+		AuthApplicationIDs: unsigned32s(f.AuthApplicationIDs),
+		AcctApplicationIDs: unsigned32s(f.AcctApplicationIDs),
+		SupportedVendorIDs: unsigned32s(f.SupportedVendorIDs),
+
+		WatchdogInterval:     duration("watchdog_interval", f.WatchdogInterval, invalid),
+		TxTimeout:            duration("tx_timeout", f.TxTimeout, invalid),
+		DialTimeout:          duration("dial_timeout", f.DialTimeout, invalid),
+		ReconnectInterval:    duration("reconnect_interval", f.ReconnectInterval, invalid),
+		MaxReconnectInterval: duration("max_reconnect_interval", f.MaxReconnectInterval, invalid),
+
+		ValidateRequests: f.ValidateRequests,
+		ValidateAnswers:  f.ValidateAnswers,
+	}}
+
+	if f.ProductName == "" {
+		invalid("product_name", "must not be empty")
+	}
+	if f.URL != "" {
+		address("url", f.URL, invalid)
+	}
+	if f.URL == "" && len(f.Peers) == 0 && len(f.Routes) == 0 {
+		invalid("url", "no url, peers or routes")
+	}
+	for i, id := range f.VendorSpecificApplicationIDs {
+		if (id.AuthApplicationID == 0) == (id.AcctApplicationID == 0) {
+			invalid(fmt.Sprintf("vendor_specific_application_ids[%d]", i), "needs exactly one of auth_application_id and acct_application_id")
+		}
+		c.VendorSpecificApplicationIDs = append(c.VendorSpecificApplicationIDs, VendorSpecificApplicationID{
+			VendorID:          datatype.Unsigned32(id.VendorID),
+			AuthApplicationID: datatype.Unsigned32(id.AuthApplicationID),
+			AcctApplicationID: datatype.Unsigned32(id.AcctApplicationID),
+		})
+	}
+
+	if f.TLS != nil {
+		c.TLS = &TLSConfig{
+			CAFile:     f.TLS.CAFile,
+			CertFile:   f.TLS.CertFile,
+			KeyFile:    f.TLS.KeyFile,
+			ServerName: f.TLS.ServerName,
+		}
+		if (f.TLS.CertFile == "") != (f.TLS.KeyFile == "") {
+			invalid("tls.cert_file", "cert_file and key_file must be set together")
+		}
+		switch f.TLS.MinVersion {
+		case "":
+		case "1.2":
+			c.TLS.MinVersion = tls.VersionTLS12
+		case "1.3":
+			c.TLS.MinVersion = tls.VersionTLS13
+		default:
+			invalid("tls.min_version", "unsupported TLS version %q", f.TLS.MinVersion)
+		}
+	}
+
+	switch strings.ToLower(f.DisconnectCause) {
+	case "", "rebooting":
+		c.DisconnectCause = DisconnectCauseRebooting
+	case "busy":
+		c.DisconnectCause = DisconnectCauseBusy
+	case "do_not_want_to_talk_to_you":
+		c.DisconnectCause = DisconnectCauseDoNotWantToTalkToYou
+	default:
+		invalid("disconnect_cause", "unknown cause %q", f.DisconnectCause)
+	}
+
+	switch strings.ToLower(f.LogLevel) {
+	case "debug":
+		c.LogLevel = LogDebug
+	case "", "info":
+		c.LogLevel = LogInfo
+	case "warn":
+		c.LogLevel = LogWarn
+	case "error":
+		c.LogLevel = LogError
+	default:
+		invalid("log_level", "unknown level %q", f.LogLevel)
+	}
+
+	c.Peers = peers("peers", f.Peers, invalid)
+	c.Policy = policy("policy", f.Policy, invalid)
+	routes := make(map[routeKey]int)
+	for i, r := range f.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		route := Route{
+			Realm:         identity(path+".realm", r.Realm, false, invalid),
+			ApplicationID: r.ApplicationID,
+			Peers:         peers(path+".peers", r.Peers, invalid),
+			Policy:        policy(path+".policy", r.Policy, invalid),
+		}
+		key := routeKey{route.Realm, route.ApplicationID}
+		if j, ok := routes[key]; ok {
+			invalid(path, "same realm and application_id as routes[%d]", j)
+		} else {
+			routes[key] = i
+		}
+		switch strings.ToLower(r.Action) {
+		case "", "local":
+			route.Action = RouteLocal
+		case "relay":
+			route.Action = RouteRelay
+		case "proxy":
+			route.Action = RouteProxy
+		case "redirect":
+			route.Action = RouteRedirect
+		default:
+			invalid(path+".action", "unknown action %q", r.Action)
+		}
+		if len(r.Peers) == 0 {
+			invalid(path+".peers", "no peers")
+		}
+		c.Routes = append(c.Routes, route)
+	}
+	return c
+}
+
+func identity(field, s string, required bool, invalid func(string, string, ...interface{})) datatype.DiameterIdentity {
+	switch {
+	case s == "" && required:
+		invalid(field, "must not be empty")
+	case strings.IndexFunc(s, unicode.IsSpace) >= 0:
+		invalid(field, "%q is not a DiameterIdentity", s)
+	}
+	return datatype.DiameterIdentity(s)
+}
+
+func duration(field, s string, invalid func(string, string, ...interface{})) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		invalid(field, "%v", err)
+	} else if d <= 0 {
+		invalid(field, "must be positive")
+	}
+	return d
+}
+
+func address(field, s string, invalid func(string, string, ...interface{})) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		invalid(field, "%v", err)
+		return
+	}
+	if host == "" {
+		invalid(field, "%q has no host", s)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		invalid(field, "%q has an invalid port", s)
+	}
+}
+
+func peers(field string, list []filePeerConfig, invalid func(string, string, ...interface{})) []PeerConfig {
+	var peers []PeerConfig
+	for i, p := range list {
+		path := fmt.Sprintf("%s[%d]", field, i)
+		address(path+".url", p.URL, invalid)
+		if p.Weight < 0 {
+			invalid(path+".weight", "must not be negative")
+		}
+		peers = append(peers, PeerConfig{
+			URL:             p.URL,
+			DestinationHost: identity(path+".destination_host", p.DestinationHost, false, invalid),
+			Weight:          p.Weight,
+			Priority:        p.Priority,
+		})
+	}
+	return peers
+}
+
+func policy(field, s string, invalid func(string, string, ...interface{})) BalancePolicy {
+	switch strings.ToLower(s) {
+	case "", "round_robin":
+		return RoundRobin
+	case "least_outstanding":
+		return LeastOutstanding
+	case "weighted":
+		return Weighted
+	}
+	invalid(field, "unknown policy %q", s)
+	return RoundRobin
+}
+
+func unsigned32s(list []uint32) []datatype.Unsigned32 {
+	var values []datatype.Unsigned32
+	for _, v := range list {
+		values = append(values, datatype.Unsigned32(v))
+	}
+	return values
+}
@@ -0,0 +1,251 @@
+package dcc
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// configErrorFields returns the sorted fields of the *ConfigErrors joined in
+// err.
+func configErrorFields(err error) []string {
+	var fields []string
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			var e *ConfigError
+			if errors.As(err, &e) {
+				fields = append(fields, e.Field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeConfig(t, "dcc.yaml", `
+origin_host: client.example.com
+origin_realm: example.com
+destination_realm: ocs.example.com
+product_name: omr
+firmware_revision: 1
+auth_application_ids: [4]
+vendor_specific_application_ids:
+  - vendor_id: 10415
+    auth_application_id: 16777238
+supported_vendor_ids: [10415]
+tls:
+  ca_file: /etc/dcc/ca.pem
+  min_version: "1.3"
+watchdog_interval: 3s
+tx_timeout: 500ms
+dial_timeout: 2s
+disconnect_cause: busy
+validate_requests: true
+log_level: warn
+peers:
+  - url: 10.0.0.1:3868
+    destination_host: ocs1
+  - url: "[2001:db8::2]:3868"
+    destination_host: ocs2
+    priority: 1
+policy: least_outstanding
+routes:
+  - realm: ocs.example.com
+    application_id: 4
+    action: relay
+    peers:
+      - url: dra.example.com:3868
+        weight: 2
+    policy: weighted
+`)
+	config, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DiameterConfig{
+		OriginHost:                   "client.example.com",
+		OriginRealm:                  "example.com",
+		DestinationRealm:             "ocs.example.com",
+		ProductName:                  "omr",
+		FirmwareRevision:             1,
+		AuthApplicationIDs:           []datatype.Unsigned32{4},
+		VendorSpecificApplicationIDs: []VendorSpecificApplicationID{{VendorID: 10415, AuthApplicationID: 16777238}},
+		SupportedVendorIDs:           []datatype.Unsigned32{10415},
+		TLS:                          &TLSConfig{CAFile: "/etc/dcc/ca.pem", MinVersion: tls.VersionTLS13},
+		LogLevel:                     LogWarn,
+		WatchdogInterval:             3 * time.Second,
+		TxTimeout:                    500 * time.Millisecond,
+		DialTimeout:                  2 * time.Second,
+		DisconnectCause:              DisconnectCauseBusy,
+		ValidateRequests:             true,
+	}
+	if !reflect.DeepEqual(config.DiameterConfig, want) {
+		t.Errorf("config\n%+v\nwant\n%+v", config.DiameterConfig, want)
+	}
+	pool := config.PoolConfig()
+	wantPeers := []PeerConfig{
+		{URL: "10.0.0.1:3868", DestinationHost: "ocs1"},
+		{URL: "[2001:db8::2]:3868", DestinationHost: "ocs2", Priority: 1},
+	}
+	if !reflect.DeepEqual(pool.Peers, wantPeers) || pool.Policy != LeastOutstanding {
+		t.Errorf("pool %+v %v", pool.Peers, pool.Policy)
+	}
+	wantRoutes := []Route{{
+		Realm:         "ocs.example.com",
+		ApplicationID: 4,
+		Action:        RouteRelay,
+		Peers:         []PeerConfig{{URL: "dra.example.com:3868", Weight: 2}},
+		Policy:        Weighted,
+	}}
+	if routes := config.RoutingConfig().Routes; !reflect.DeepEqual(routes, wantRoutes) {
+		t.Errorf("routes %+v", routes)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfig(t, "dcc.json", `{
+		"url": "127.0.0.1:3868",
+		"origin_host": "client",
+		"origin_realm": "localhost",
+		"destination_realm": "localhost",
+		"product_name": "omr",
+		"acct_application_ids": [3]
+	}`)
+	config, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.URL != "127.0.0.1:3868" || config.OriginHost != "client" || !reflect.DeepEqual(config.AcctApplicationIDs, []datatype.Unsigned32{3}) {
+		t.Errorf("unexpected config %+v", config.DiameterConfig)
+	}
+}
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	path := writeConfig(t, "dcc.yaml", `
+origin_host: client
+origin_realm: localhost
+destination_realm: localhost
+product_name: omr
+auth_application_ids: [4]
+peers:
+  - url: 10.0.0.1:3868
+`)
+	config, err := loadConfig(path, []string{
+		"DCC_ORIGIN_HOST=jenkins",
+		"DCC_AUTH_APPLICATION_IDS=4, 16777238",
+		"DCC_WATCHDOG_INTERVAL=3s",
+		"DCC_VALIDATE_ANSWERS=true",
+		"DCC_TLS_SERVER_NAME=ocs.example.com",
+		"DCC_PEERS_0_DESTINATION_HOST=ocs1",
+		"DCC_PEERS_1_URL=10.0.0.2:3868",
+		"DCC_PEERS_1_PRIORITY=1",
+		"DCC_CONFIG=ignored",
+		"HOME=/root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.OriginHost != "jenkins" || config.WatchdogInterval != 3*time.Second || !config.ValidateAnswers {
+		t.Errorf("unexpected config %+v", config.DiameterConfig)
+	}
+	if !reflect.DeepEqual(config.AuthApplicationIDs, []datatype.Unsigned32{4, 16777238}) {
+		t.Errorf("auth application ids %v", config.AuthApplicationIDs)
+	}
+	if config.TLS == nil || config.TLS.ServerName != "ocs.example.com" {
+		t.Errorf("tls %+v", config.TLS)
+	}
+	wantPeers := []PeerConfig{
+		{URL: "10.0.0.1:3868", DestinationHost: "ocs1"},
+		{URL: "10.0.0.2:3868", Priority: 1},
+	}
+	if !reflect.DeepEqual(config.Peers, wantPeers) {
+		t.Errorf("peers %+v", config.Peers)
+	}
+
+	config, err = loadConfig("", []string{
+		"DCC_URL=127.0.0.1:3868",
+		"DCC_ORIGIN_HOST=client",
+		"DCC_ORIGIN_REALM=localhost",
+		"DCC_DESTINATION_REALM=localhost",
+		"DCC_PRODUCT_NAME=omr",
+	})
+	if err != nil || config.URL != "127.0.0.1:3868" {
+		t.Errorf("config from the environment alone: %+v %v", config, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := writeConfig(t, "dcc.yaml", `
+origin_host: ""
+origin_realm: local host
+destination_realm: localhost
+product_name: omr
+watchdog_interval: -1s
+tx_timeout: soon
+vendor_specific_application_ids:
+  - vendor_id: 10415
+tls:
+  cert_file: client.pem
+  min_version: "1.0"
+peers:
+  - url: 10.0.0.1
+  - url: 10.0.0.2:99999
+routes:
+  - action: bounce
+  - peers:
+      - url: 10.0.0.3:3868
+`)
+	_, err := loadConfig(path, nil)
+	want := []string{
+		"origin_host",
+		"origin_realm",
+		"peers[0].url",
+		"peers[1].url",
+		"routes[0].action",
+		"routes[0].peers",
+		"routes[1]",
+		"tls.cert_file",
+		"tls.min_version",
+		"tx_timeout",
+		"vendor_specific_application_ids[0]",
+		"watchdog_interval",
+	}
+	if fields := configErrorFields(err); !reflect.DeepEqual(fields, want) {
+		t.Errorf("errors on\n%v\nwant\n%v\n%v", fields, want, err)
+	}
+
+	_, err = loadConfig(path, []string{"DCC_VENDOR_ID=ten", "DCC_PEERS_0_WEIGHT=heavy"})
+	if fields := configErrorFields(err); !reflect.DeepEqual(fields, []string{"peers[0].weight", "vendor_id"}) {
+		t.Errorf("errors on %v: %v", fields, err)
+	}
+
+	if _, err := loadConfig(writeConfig(t, "dcc.yaml", "origin_hots: client\n"), nil); err == nil {
+		t.Error("unknown field accepted")
+	}
+	if _, err := loadConfig(writeConfig(t, "dcc.json", `{"origin_host": 1}`), nil); err == nil {
+		t.Error("mistyped field accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package dcc
+
+import (
+	"fmt"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+type ErrorKind int
+
+const (
+	// KindTransport covers failed dials and writes and lost connections.
+	KindTransport ErrorKind = iota
+	// KindTimeout covers expired Tx timers, including the one on the CEA.
+	KindTimeout
+	// KindProtocol covers messages from the peer the client cannot accept.
+	KindProtocol
+	// KindPeerRejected covers capabilities exchanges the peer or the client
+	// turned down and, with ValidateAnswers, requests the peer answered with
+	// a permanent failure.
+	KindPeerRejected
+	// KindInvalidRequest covers requests the client did not send because they
+	// break the rules of the dictionary.
+	KindInvalidRequest
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindTransport:
+		return "transport"
+	case KindTimeout:
+		return "timeout"
+	case KindProtocol:
+		return "protocol"
+	case KindPeerRejected:
+		return "peer rejected"
+	case KindInvalidRequest:
+		return "invalid request"
+	}
+	return "unknown"
+}
+
+// Error is the error returned from Do, passed to Serve requests and reported
+// to the ErrorHandler. Err is the underlying cause, such as ErrTxTimeout or a
+// *CapabilitiesError, and can be matched with errors.Is and errors.As.
+// ErrClientClosed and context errors are returned as they are.
+type Error struct {
+	Kind      ErrorKind
+	Peer      string
+	Command   Command
+	SessionID datatype.UTF8String
+	Err       error
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("dcc: %s error", e.Kind)
+	if e.Peer != "" {
+		s += " with " + e.Peer
+	}
+	if e.Command != (Command{}) {
+		s += fmt.Sprintf(" on command %d of application %d", e.Command.Code, e.Command.ApplicationID)
+	}
+	if e.SessionID != "" {
+		s += fmt.Sprintf(" for session %s", e.SessionID)
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FailableRequest is implemented by requests passed to Serve that want to be
+// told why they did not get an answer. Errors of other requests go to the
+// ErrorHandler.
+type FailableRequest interface {
+	Request
+	Fail(error)
+}
+
+// ErrorHandler is called for failures that have no caller waiting on them,
+// such as a DWR that could not be written. It is called from the client's
+// goroutines and must not block.
+type ErrorHandler func(error)
+
+var (
+	capabilitiesExchangeCommand = Command{Code: diam.CapabilitiesExchange}
+	deviceWatchdogCommand       = Command{Code: diam.DeviceWatchdog}
+)
+
+func (d *diameterClient) peerName() string {
+	if d.config.DestinationHost != "" {
+		return string(d.config.DestinationHost)
+	}
+	return d.config.URL
+}
+
+func (d *diameterClient) newError(kind ErrorKind, command Command, sessionID datatype.UTF8String, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Kind: kind, Peer: d.peerName(), Command: command, SessionID: sessionID, Err: err}
+}
+
+func (d *diameterClient) report(err error) {
+	if d.logs(LogError) {
+		e := LogEntry{Event: LogErrorReported, Level: LogError, Err: err}
+		if reported, ok := err.(*Error); ok {
+			e.Command, e.SessionID = reported.Command, reported.SessionID
+		}
+		d.log(e)
+	}
+	reportError(d.config.ErrorHandler, d.errorCh, err)
+}
+
+// reportError hands a background failure to handler and to errorCh. It never
+// blocks: the error is dropped when nobody reads errorCh.
+func reportError(handler ErrorHandler, errorCh chan error, err error) {
+	if handler != nil {
+		handler(err)
+	}
+	select {
+	case errorCh <- err:
+	default:
+	}
+}
+
+// fail delivers the error of a request passed to Serve.
+func fail(request Request, handler ErrorHandler, errorCh chan error, err error) {
+	if r, ok := request.(FailableRequest); ok {
+		r.Fail(err)
+		return
+	}
+	reportError(handler, errorCh, err)
+}
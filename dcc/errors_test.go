@@ -0,0 +1,121 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+type failableRequest struct {
+	mockRequest
+	errCh chan error
+}
+
+func (r *failableRequest) Fail(err error) {
+	r.errCh <- err
+}
+
+// newSilentServer returns a server that never answers CCRs.
+func newSilentServer() *Server {
+	server := NewTestServer()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+	return server
+}
+
+func TestClientDoReturnsTypedTimeout(t *testing.T) {
+	server := newSilentServer()
+	defer server.Close()
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.TxTimeout = 50 * time.Millisecond
+	})
+	defer client.Close()
+
+	_, err := client.Do(context.Background(), &mockRequest{})
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if e.Kind != KindTimeout || e.Err != ErrTxTimeout {
+		t.Errorf("unexpected error %v", e)
+	}
+	if e.Peer != "srv" || e.Command != CreditControlCommand || e.SessionID == "" {
+		t.Errorf("unexpected context %+v", e)
+	}
+}
+
+func TestClientServeFailsFailableRequest(t *testing.T) {
+	handled := make(chan error, 1)
+	server := newSilentServer()
+	defer server.Close()
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.TxTimeout = 50 * time.Millisecond
+		c.ErrorHandler = func(err error) {
+			select {
+			case handled <- err:
+			default:
+			}
+		}
+	})
+	defer client.Close()
+
+	request := &failableRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, errCh: make(chan error, 1)}
+	if err := client.Serve(request); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-request.errCh:
+		if !errors.Is(err, ErrTxTimeout) {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not failed")
+	}
+	select {
+	case err := <-handled:
+		t.Errorf("failure of a FailableRequest went to the ErrorHandler: %v", err)
+	default:
+	}
+}
+
+func TestClientReportsWithoutErrorNotifyReader(t *testing.T) {
+	var count int
+	done := make(chan struct{})
+	const requests = 20
+
+	client := NewTestClient("")
+	client.config.ErrorHandler = func(err error) {
+		var e *Error
+		if !errors.As(err, &e) || e.Kind != KindProtocol {
+			t.Errorf("unexpected error %v", err)
+		}
+		if count++; count == requests {
+			close(done)
+		}
+	}
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	go func() {
+		for i := uint32(0); i < requests; i++ {
+			m := diam.NewMessage(9999, diam.RequestFlag, 4, i, i, dict.Default)
+			m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+			m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+			m.WriteTo(peer)
+		}
+	}()
+	go io.Copy(ioutil.Discard, peer)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("read loop blocked on unread errors")
+	}
+}
@@ -0,0 +1,220 @@
+package dcc
+
+import (
+	"fmt"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+type EventType int
+
+const (
+	// EventReAuth is reported for every Re-Auth-Request of the peer.
+	EventReAuth EventType = iota
+	// EventAbortSession is reported for every Abort-Session-Request.
+	EventAbortSession
+	// EventUnsupportedCommand and EventUnsupportedApplication are reported
+	// for requests rejected with 3001 and 3007.
+	EventUnsupportedCommand
+	EventUnsupportedApplication
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventReAuth:
+		return "RE-AUTH"
+	case EventAbortSession:
+		return "ABORT-SESSION"
+	case EventUnsupportedCommand:
+		return "UNSUPPORTED-COMMAND"
+	case EventUnsupportedApplication:
+		return "UNSUPPORTED-APPLICATION"
+	}
+	return "UNKNOWN"
+}
+
+// Event describes a request the peer sent to the client and the Result-Code
+// it was answered with.
+type Event struct {
+	Type       EventType
+	SessionID  datatype.UTF8String
+	ResultCode uint32
+	Message    *diam.Message
+}
+
+// UnsupportedRequestError is reported, as the cause of a KindProtocol Error,
+// when the peer sends a request the client does not handle.
+type UnsupportedRequestError struct {
+	ApplicationID uint32
+	CommandCode   uint32
+	ResultCode    uint32
+}
+
+func (e *UnsupportedRequestError) Error() string {
+	return fmt.Sprintf("dcc: rejected request for command %d of application %d with Result-Code %d", e.CommandCode, e.ApplicationID, e.ResultCode)
+}
+
+// SessionHandler decides how server-initiated requests about a session are
+// answered. The returned Result-Code goes into the RAA or ASA. When it is
+// DIAMETER_SUCCESS and the returned Request is not nil, the request is sent
+// after the answer: a CCR-UPDATE for a RAR, as RFC 4006 section 5.5 asks, or
+// a CCR-TERMINATE for an ASR. It should implement SessionRequest so that it
+// continues sessionID.
+//
+// Both methods are called from the connection's read loop and must not block.
+type SessionHandler interface {
+	ReAuth(sessionID datatype.UTF8String, m *diam.Message) (uint32, Request)
+	AbortSession(sessionID datatype.UTF8String, m *diam.Message) (uint32, Request)
+}
+
+// Subscribe returns a channel that receives every Event of the client. Events
+// are dropped for subscribers that do not keep up.
+func (d *diameterClient) Subscribe() <-chan Event {
+	ch := make(chan Event, 10)
+	d.subscribe(ch)
+	return ch
+}
+
+func (d *diameterClient) subscribe(ch chan Event) {
+	d.subscribersMu.Lock()
+	defer d.subscribersMu.Unlock()
+	d.subscribers = append(d.subscribers, ch)
+}
+
+func (d *diameterClient) notifyEvent(e Event) {
+	d.subscribersMu.Lock()
+	defer d.subscribersMu.Unlock()
+	for _, ch := range d.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (d *diameterClient) handleRAR() diam.HandlerFunc {
+	return d.handleSessionRequest(EventReAuth)
+}
+
+func (d *diameterClient) handleASR() diam.HandlerFunc {
+	return d.handleSessionRequest(EventAbortSession)
+}
+
+func (d *diameterClient) handleSessionRequest(eventType EventType) diam.HandlerFunc {
+	return func(conn diam.Conn, m *diam.Message) {
+		d.receivedTraffic()
+		d.logMessage(LogRequestReceived, m, 0, nil)
+		if !d.supportsApplication(m.Header.ApplicationID) {
+			d.rejectRequest(conn, m, diam.ApplicationUnsupported)
+			return
+		}
+
+		var sessionID datatype.UTF8String
+		var resultCode uint32
+		var followUp Request
+		// failed is the content of the Failed-AVP of a rejected request: the
+		// malformed Session-Id, or an empty one when it is missing, as RFC
+		// 6733 section 7.5 asks.
+		var failed *diam.AVP
+		a, err := m.FindAVP(avp.SessionID)
+		ok := err == nil
+		if ok {
+			sessionID, ok = a.Data.(datatype.UTF8String)
+		}
+		switch {
+		case err != nil:
+			resultCode = diam.MissingAVP
+			failed = diam.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(""))
+		case !ok:
+			resultCode = diam.InvalidAVPValue
+			failed = a
+		case d.config.SessionHandler == nil:
+			resultCode = diam.UnknownSessionID
+		case eventType == EventReAuth:
+			resultCode, followUp = d.config.SessionHandler.ReAuth(sessionID, m)
+		default:
+			resultCode, followUp = d.config.SessionHandler.AbortSession(sessionID, m)
+		}
+
+		answer := d.answer(m, sessionID, resultCode)
+		if failed != nil {
+			answer.NewAVP(avp.FailedAVP, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{failed}})
+		}
+		d.writeAnswer(conn, answer)
+
+		d.notifyEvent(Event{Type: eventType, SessionID: sessionID, ResultCode: resultCode, Message: m})
+		if resultCode == diam.Success && followUp != nil {
+			go func() {
+				if err := d.Serve(followUp); err != nil {
+					d.report(err)
+				}
+			}()
+		}
+	}
+}
+
+// handleUnknown takes every message no other handler is registered for.
+// Answers are matched against the pending requests; requests are rejected
+// with DIAMETER_APPLICATION_UNSUPPORTED when the application was not
+// advertised and with DIAMETER_COMMAND_UNSUPPORTED otherwise.
+func (d *diameterClient) handleUnknown() diam.HandlerFunc {
+	handleAnswer := d.handleAnswer()
+	return func(conn diam.Conn, m *diam.Message) {
+		if m.Header.CommandFlags&diam.RequestFlag == 0 {
+			handleAnswer(conn, m)
+			return
+		}
+		d.receivedTraffic()
+		d.logMessage(LogRequestReceived, m, 0, nil)
+		if !d.supportsApplication(m.Header.ApplicationID) {
+			d.rejectRequest(conn, m, diam.ApplicationUnsupported)
+			return
+		}
+		d.rejectRequest(conn, m, diam.CommandUnsupported)
+	}
+}
+
+func (d *diameterClient) rejectRequest(conn diam.Conn, m *diam.Message, resultCode uint32) {
+	var sessionID datatype.UTF8String
+	if a, err := m.FindAVP(avp.SessionID); err == nil {
+		sessionID, _ = a.Data.(datatype.UTF8String)
+	}
+	d.writeAnswer(conn, d.answer(m, sessionID, resultCode))
+
+	eventType := EventUnsupportedCommand
+	if resultCode == diam.ApplicationUnsupported {
+		eventType = EventUnsupportedApplication
+	}
+	d.notifyEvent(Event{Type: eventType, SessionID: sessionID, ResultCode: resultCode, Message: m})
+	command := Command{ApplicationID: m.Header.ApplicationID, Code: m.Header.CommandCode}
+	d.report(d.newError(KindProtocol, command, sessionID, &UnsupportedRequestError{
+		ApplicationID: m.Header.ApplicationID,
+		CommandCode:   m.Header.CommandCode,
+		ResultCode:    resultCode,
+	}))
+}
+
+func (d *diameterClient) writeAnswer(conn diam.Conn, m *diam.Message) {
+	_, err := m.WriteTo(conn)
+	d.logMessage(LogAnswerSent, m, 0, err)
+}
+
+// answer builds the answer to a request from the peer. Only the P bit of the
+// request is kept; protocol errors, the 3xxx Result-Codes, are flagged with
+// the E bit as RFC 6733 section 7.1.3 requires.
+func (d *diameterClient) answer(m *diam.Message, sessionID datatype.UTF8String, resultCode uint32) *diam.Message {
+	flags := m.Header.CommandFlags & diam.ProxiableFlag
+	if resultCode >= 3000 && resultCode < 4000 {
+		flags |= diam.ErrorFlag
+	}
+	answerMessage := diam.NewMessage(m.Header.CommandCode, flags, m.Header.ApplicationID, m.Header.HopByHopID, m.Header.EndToEndID, m.Dictionary())
+	if sessionID != "" {
+		answerMessage.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID)
+	}
+	answerMessage.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(resultCode))
+	answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
+	answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
+	return answerMessage
+}
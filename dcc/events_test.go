@@ -0,0 +1,354 @@
+package dcc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+type testSessionHandler struct {
+	resultCode uint32
+	followUp   Request
+}
+
+func (h *testSessionHandler) ReAuth(sessionID datatype.UTF8String, m *diam.Message) (uint32, Request) {
+	return h.resultCode, h.followUp
+}
+
+func (h *testSessionHandler) AbortSession(sessionID datatype.UTF8String, m *diam.Message) (uint32, Request) {
+	return h.resultCode, h.followUp
+}
+
+// SendSessionRequest sends a RAR or ASR for sessionID to the client and
+// returns the answer.
+func (s *Server) SendSessionRequest(t *testing.T, code uint32, sessionID datatype.UTF8String) *diam.Message {
+	answerCh := make(chan *diam.Message, 1)
+	answer := diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		answerCh <- m
+	})
+	s.mux.Handle("RAA", answer)
+	s.mux.Handle("ASA", answer)
+
+	m := diam.NewRequest(code, 4, nil)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, datatype.DiameterIdentity("client"))
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4))
+	if code == diam.ReAuth {
+		m.NewAVP(avp.ReAuthRequestType, avp.Mbit, 0, datatype.Enumerated(0))
+	}
+	s.writeMu.Lock()
+	_, err := m.WriteTo(s.Conn())
+	s.writeMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case a := <-answerCh:
+		return a
+	case <-time.After(time.Second):
+		t.Fatal("no answer from the client")
+	}
+	return nil
+}
+
+func checkSessionAnswer(t *testing.T, m *diam.Message, sessionID datatype.UTF8String, resultCode uint32) {
+	if len(m.AVP) == 0 || m.AVP[0].Code != avp.SessionID || m.AVP[0].Data != sessionID {
+		t.Errorf("answer does not start with Session-Id %s: %v", sessionID, m)
+	}
+	for code, want := range map[uint32]interface{}{
+		avp.ResultCode:  datatype.Unsigned32(resultCode),
+		avp.OriginHost:  datatype.DiameterIdentity("client"),
+		avp.OriginRealm: datatype.DiameterIdentity("localhost"),
+	} {
+		a, err := m.FindAVP(code)
+		if err != nil {
+			t.Errorf("answer is missing AVP %d", code)
+			continue
+		}
+		if a.Data != want {
+			t.Errorf("AVP %d is %v, want %v", code, a.Data, want)
+		}
+	}
+}
+
+func TestClientAnswersRARAndSendsUpdate(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	ccrCh := server.CaptureRequests("CCR")
+
+	update := &sessionRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, sessionID: "client;1;7"}
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.SessionHandler = &testSessionHandler{resultCode: diam.Success, followUp: update}
+	})
+	defer client.Close()
+	events := client.Subscribe()
+
+	raa := server.SendSessionRequest(t, diam.ReAuth, "client;1;7")
+	checkSessionAnswer(t, raa, "client;1;7", diam.Success)
+
+	select {
+	case ccr := <-ccrCh:
+		if sessionID, err := ccr.FindAVP(avp.SessionID); err != nil || sessionID.Data != datatype.UTF8String("client;1;7") {
+			t.Errorf("CCR-UPDATE sent for session %v", sessionID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no CCR-UPDATE after the RAR")
+	}
+	select {
+	case <-update.ResponseNotify():
+	case <-time.After(time.Second):
+		t.Fatal("CCR-UPDATE was not answered")
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != EventReAuth || e.SessionID != "client;1;7" || e.ResultCode != diam.Success {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Error("no event for the RAR")
+	}
+}
+
+func TestClientAnswersRARForUnknownSession(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.SessionHandler = nil
+	})
+	defer client.Close()
+
+	raa := server.SendSessionRequest(t, diam.ReAuth, "client;1;8")
+	checkSessionAnswer(t, raa, "client;1;8", diam.UnknownSessionID)
+}
+
+func TestClientAnswersASR(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.SessionHandler = &testSessionHandler{resultCode: diam.Success}
+	})
+	defer client.Close()
+	events := client.Subscribe()
+
+	asa := server.SendSessionRequest(t, diam.AbortSession, "client;1;9")
+	checkSessionAnswer(t, asa, "client;1;9", diam.Success)
+
+	select {
+	case e := <-events:
+		if e.Type != EventAbortSession || e.SessionID != "client;1;9" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event for the ASR")
+	}
+}
+
+// pipeClient attaches client to one end of an in-memory connection and
+// returns the other end, for tests that write raw messages.
+func pipeClient(client *diameterClient) net.Conn {
+	clientSide, peerSide := net.Pipe()
+	conn := newPeerConn(clientSide, client.newConn())
+	client.connMu.Lock()
+	client.conn = conn
+	client.connMu.Unlock()
+	return peerSide
+}
+
+// readRawMessage decodes a message whose command may be missing from the
+// dictionary, keeping the base protocol AVPs.
+func readRawMessage(t *testing.T, r io.Reader) *diam.Message {
+	b := make([]byte, diam.HeaderLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	h, err := diam.DecodeHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, h.MessageLength-diam.HeaderLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	m := diam.NewMessage(h.CommandCode, h.CommandFlags, h.ApplicationID, h.HopByHopID, h.EndToEndID, dict.Default)
+	for len(body) > 0 {
+		a, err := diam.DecodeAVP(body, 0, dict.Default)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.AVP = append(m.AVP, a)
+		body = body[a.Len():]
+	}
+	return m
+}
+
+func TestClientRejectsUnsupportedRequests(t *testing.T) {
+	client := NewTestClient("")
+	peer := pipeClient(client)
+	defer peer.Close()
+	events := client.Subscribe()
+
+	for _, c := range []struct {
+		code, applicationID, resultCode uint32
+		eventType                       EventType
+	}{
+		{9999, 4, diam.CommandUnsupported, EventUnsupportedCommand},
+		{diam.CreditControl, 4, diam.CommandUnsupported, EventUnsupportedCommand},
+		{diam.ReAuth, 16777238, diam.ApplicationUnsupported, EventUnsupportedApplication},
+		{9999, 16777238, diam.ApplicationUnsupported, EventUnsupportedApplication},
+	} {
+		m := diam.NewMessage(c.code, diam.RequestFlag|diam.ProxiableFlag, c.applicationID, 1, 2, dict.Default)
+		m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("srv;1;1"))
+		m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+		m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		if _, err := m.WriteTo(peer); err != nil {
+			t.Fatal(err)
+		}
+
+		answer := readRawMessage(t, peer)
+		if answer.Header.CommandCode != c.code || answer.Header.HopByHopID != 1 || answer.Header.EndToEndID != 2 {
+			t.Errorf("command %d: answer header %+v", c.code, answer.Header)
+		}
+		if answer.Header.CommandFlags&diam.RequestFlag != 0 || answer.Header.CommandFlags&diam.ErrorFlag == 0 {
+			t.Errorf("command %d: answer flags %#x", c.code, answer.Header.CommandFlags)
+		}
+		checkSessionAnswer(t, answer, "srv;1;1", c.resultCode)
+
+		select {
+		case e := <-events:
+			if e.Type != c.eventType || e.ResultCode != c.resultCode {
+				t.Errorf("command %d: unexpected event %+v", c.code, e)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("command %d: no event", c.code)
+		}
+	}
+
+	// The stream stays in sync after the unknown commands.
+	dwr := diam.NewRequest(diam.DeviceWatchdog, 0, dict.Default)
+	dwr.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	dwr.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	if _, err := dwr.WriteTo(peer); err != nil {
+		t.Fatal(err)
+	}
+	if dwa := readRawMessage(t, peer); dwa.Header.CommandCode != diam.DeviceWatchdog {
+		t.Errorf("expected a DWA, got %v", dwa)
+	}
+}
+
+func TestClientReportsUnsupportedRequest(t *testing.T) {
+	client := NewTestClient("")
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	m := diam.NewMessage(9999, diam.RequestFlag, 4, 1, 2, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+
+	go func() {
+		m.WriteTo(peer)
+		io.Copy(ioutil.Discard, peer)
+	}()
+
+	select {
+	case err := <-client.ErrorNotify():
+		var e *UnsupportedRequestError
+		if !errors.As(err, &e) || e.CommandCode != 9999 || e.ApplicationID != 4 || e.ResultCode != diam.CommandUnsupported {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unsupported request was not reported")
+	}
+}
+
+func TestClientAnswersRetransmittedRARWithoutTFlag(t *testing.T) {
+	client := NewTestClient("")
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	m := diam.NewMessage(diam.ReAuth, diam.RequestFlag|diam.ProxiableFlag|diam.RetransmittedFlag, 4, 1, 2, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("srv;1;2"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4))
+	m.NewAVP(avp.ReAuthRequestType, avp.Mbit, 0, datatype.Enumerated(0))
+	if _, err := m.WriteTo(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := readRawMessage(t, peer)
+	if answer.Header.CommandFlags != diam.ProxiableFlag {
+		t.Errorf("answer flags %#x, want %#x", answer.Header.CommandFlags, diam.ProxiableFlag)
+	}
+	checkSessionAnswer(t, answer, "srv;1;2", diam.UnknownSessionID)
+}
+
+func TestClientRejectsMalformedSessionID(t *testing.T) {
+	client := NewTestClient("")
+	client.config.SessionHandler = &testSessionHandler{resultCode: diam.Success}
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	m := diam.NewMessage(diam.ReAuth, diam.RequestFlag, 4, 1, 2, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.OctetString("srv;1;3"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	client.connMu.Lock()
+	conn := client.conn
+	client.connMu.Unlock()
+	go client.handleRAR()(conn, m)
+
+	answer := readRawMessage(t, peer)
+	if answer.Header.CommandFlags&diam.ErrorFlag != 0 {
+		t.Errorf("answer flags %#x", answer.Header.CommandFlags)
+	}
+	if _, err := answer.FindAVP(avp.SessionID); err == nil {
+		t.Errorf("answer echoes the malformed Session-Id: %v", answer)
+	}
+	e := answerError(dict.Default, answer)
+	if e == nil || e.Result.Code != diam.InvalidAVPValue {
+		t.Fatalf("unexpected answer %v", answer)
+	}
+	if len(e.FailedAVP) != 1 || e.FailedAVP[0].Code != avp.SessionID {
+		t.Errorf("unexpected Failed-AVP %v", e.FailedAVP)
+	}
+}
+
+func TestClientRejectsRARWithoutSessionID(t *testing.T) {
+	client := NewTestClient("")
+	client.config.SessionHandler = &testSessionHandler{resultCode: diam.Success}
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	m := diam.NewMessage(diam.ReAuth, diam.RequestFlag, 4, 1, 2, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	client.connMu.Lock()
+	conn := client.conn
+	client.connMu.Unlock()
+	go client.handleRAR()(conn, m)
+
+	answer := readRawMessage(t, peer)
+	e := answerError(dict.Default, answer)
+	if e == nil || e.Result.Code != diam.MissingAVP {
+		t.Fatalf("unexpected answer %v", answer)
+	}
+	if len(e.FailedAVP) != 1 || e.FailedAVP[0].Name != "Session-Id" || e.FailedAVP[0].Value != datatype.UTF8String("") {
+		t.Errorf("unexpected Failed-AVP %v", e.FailedAVP)
+	}
+}
@@ -0,0 +1,195 @@
+package dcc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// LogLevel is the verbosity of a LogEntry. Entries below the configured
+// LogLevel are not built at all; the zero value logs LogInfo and above.
+type LogLevel int
+
+const (
+	// LogDebug covers DWR/DWA and every application request written.
+	LogDebug LogLevel = iota - 1
+	// LogInfo covers the other base protocol messages, application answers
+	// and watchdog state changes.
+	LogInfo
+	// LogWarn covers failed writes and requests, protocol errors and
+	// permanent failures in answers, and peers going down.
+	LogWarn
+	// LogError covers the failures that no caller gets back, which are
+	// reported to the ErrorHandler and on ErrorNotify.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+type LogEvent int
+
+const (
+	LogRequestSent LogEvent = iota
+	LogAnswerReceived
+	LogRequestReceived
+	LogAnswerSent
+	// LogRequestFailed is logged when Do or Serve gets no answer.
+	LogRequestFailed
+	LogStateChanged
+	LogConnectFailed
+	// LogErrorReported is logged for every error the client reports.
+	LogErrorReported
+)
+
+func (e LogEvent) String() string {
+	switch e {
+	case LogRequestSent:
+		return "request sent"
+	case LogAnswerReceived:
+		return "answer received"
+	case LogRequestReceived:
+		return "request received"
+	case LogAnswerSent:
+		return "answer sent"
+	case LogRequestFailed:
+		return "request failed"
+	case LogStateChanged:
+		return "watchdog state changed"
+	case LogConnectFailed:
+		return "connect failed"
+	case LogErrorReported:
+		return "error reported"
+	}
+	return "unknown"
+}
+
+// LogEntry is a structured log record. Fields that do not apply to the
+// event are left zero: Latency is set for answers to requests of the client,
+// State and PreviousState only for LogStateChanged.
+type LogEntry struct {
+	Event LogEvent
+	Level LogLevel
+	Peer  string
+
+	Command     Command
+	CommandName string
+	HopByHopID  uint32
+	EndToEndID  uint32
+	SessionID   datatype.UTF8String
+	ResultCode  uint32
+	Latency     time.Duration
+
+	State         WatchdogState
+	PreviousState WatchdogState
+
+	Err error
+}
+
+// Logger receives the LogEntries of the client. It is called from the
+// client's goroutines, including the connection's read loop, and must not
+// block.
+type Logger interface {
+	Log(LogEntry)
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(LogEntry)
+
+func (f LoggerFunc) Log(e LogEntry) {
+	f(e)
+}
+
+func (d *diameterClient) logs(level LogLevel) bool {
+	return d.config.Logger != nil && level >= d.config.LogLevel
+}
+
+func (d *diameterClient) log(e LogEntry) {
+	if !d.logs(e.Level) {
+		return
+	}
+	e.Peer = d.peerName()
+	d.config.Logger.Log(e)
+}
+
+// logMessage logs a message written to or read from the peer. err is the
+// error of a failed write.
+func (d *diameterClient) logMessage(event LogEvent, m *diam.Message, latency time.Duration, err error) {
+	if e, ok := d.messageEntry(event, m, latency, err); ok {
+		d.log(e)
+	}
+}
+
+// messageEntry builds the LogEntry of a message, reporting false when its
+// level is not logged.
+func (d *diameterClient) messageEntry(event LogEvent, m *diam.Message, latency time.Duration, err error) (LogEntry, bool) {
+	if d.config.Logger == nil {
+		return LogEntry{}, false
+	}
+	e := LogEntry{
+		Event:      event,
+		Command:    Command{ApplicationID: m.Header.ApplicationID, Code: m.Header.CommandCode},
+		HopByHopID: m.Header.HopByHopID,
+		EndToEndID: m.Header.EndToEndID,
+		ResultCode: resultCode(m),
+		Latency:    latency,
+		Err:        err,
+	}
+	if a, err := m.FindAVP(avp.SessionID); err == nil {
+		e.SessionID, _ = a.Data.(datatype.UTF8String)
+	}
+
+	switch {
+	case err != nil || e.ResultCode >= 3000:
+		e.Level = LogWarn
+	case e.Command == deviceWatchdogCommand:
+		e.Level = LogDebug
+	case e.Command.ApplicationID != 0 && m.Header.CommandFlags&diam.RequestFlag != 0:
+		e.Level = LogDebug
+	default:
+		e.Level = LogInfo
+	}
+	if !d.logs(e.Level) {
+		return LogEntry{}, false
+	}
+	if command, err := d.dictionary().FindCommand(e.Command.ApplicationID, e.Command.Code); err == nil {
+		e.CommandName = command.Name
+	}
+	return e, true
+}
+
+func (d *diameterClient) logStateChange(previous, state WatchdogState) {
+	level := LogInfo
+	if state == WatchdogSuspect || state == WatchdogDown {
+		level = LogWarn
+	}
+	d.log(LogEntry{Event: LogStateChanged, Level: level, State: state, PreviousState: previous})
+}
+
+// markSent records the time a CER or DWR was written in *sentAt, and
+// sinceSent returns how long ago that was.
+func markSent(sentAt *int64) {
+	atomic.StoreInt64(sentAt, time.Now().UnixNano())
+}
+
+func sinceSent(sentAt *int64) time.Duration {
+	sent := atomic.LoadInt64(sentAt)
+	if sent == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, sent))
+}
@@ -0,0 +1,170 @@
+package dcc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (l *recordingLogger) Log(e LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+}
+
+func (l *recordingLogger) find(event LogEvent, command Command) (LogEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.Event == event && e.Command == command {
+			return e, true
+		}
+	}
+	return LogEntry{}, false
+}
+
+func TestClientLogsExchanges(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	logger := &recordingLogger{}
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.Logger = logger
+		c.LogLevel = LogDebug
+	})
+	defer client.Close()
+
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	cea, ok := logger.find(LogAnswerReceived, capabilitiesExchangeCommand)
+	if !ok {
+		t.Fatal("CEA was not logged")
+	}
+	if cea.Level != LogInfo || cea.ResultCode != diam.Success || cea.Peer != "srv" || cea.CommandName != "Capabilities-Exchange" {
+		t.Errorf("unexpected CEA entry %+v", cea)
+	}
+	select {
+	case <-client.watchdogAliveNotify():
+	case <-time.After(time.Second):
+		t.Fatal("no DWA received")
+	}
+	if dwa, ok := logger.find(LogAnswerReceived, deviceWatchdogCommand); !ok || dwa.Level != LogDebug || dwa.Latency <= 0 {
+		t.Errorf("unexpected DWA entry %+v", dwa)
+	}
+
+	sent, ok := logger.find(LogRequestSent, CreditControlCommand)
+	if !ok || sent.Level != LogDebug || sent.SessionID == "" {
+		t.Fatalf("unexpected CCR entry %+v", sent)
+	}
+	answer, ok := logger.find(LogAnswerReceived, CreditControlCommand)
+	if !ok {
+		t.Fatal("CCA was not logged")
+	}
+	if answer.SessionID != sent.SessionID || answer.EndToEndID != sent.EndToEndID {
+		t.Errorf("CCA entry %+v does not match CCR entry %+v", answer, sent)
+	}
+	if answer.Level != LogInfo || answer.ResultCode != diam.Success || answer.Latency <= 0 {
+		t.Errorf("unexpected CCA entry %+v", answer)
+	}
+
+	if e, ok := logger.find(LogStateChanged, Command{}); !ok || e.State != WatchdogOkay || e.PreviousState != WatchdogInitial {
+		t.Errorf("unexpected state change %+v", e)
+	}
+}
+
+func TestClientLogLevel(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	logger := &recordingLogger{}
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.Logger = logger
+		c.LogLevel = LogInfo
+	})
+	defer client.Close()
+
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, e := range logger.entries {
+		if e.Level < LogInfo {
+			t.Errorf("entry below LogInfo: %+v", e)
+		}
+	}
+	if len(logger.entries) == 0 {
+		t.Error("nothing was logged")
+	}
+}
+
+func TestClientLogsFailedRequest(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+
+	logger := &recordingLogger{}
+	client := NewTestClient(server.Address)
+	client.config.TxTimeout = 50 * time.Millisecond
+	client.config.Logger = logger
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Do(context.Background(), &mockRequest{})
+	e, ok := logger.find(LogRequestFailed, CreditControlCommand)
+	if !ok {
+		t.Fatal("failed request was not logged")
+	}
+	if e.Level != LogWarn || e.SessionID == "" || e.Err == nil {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestClientLogsReportedErrors(t *testing.T) {
+	logger := &recordingLogger{}
+	client := NewTestClient("")
+	client.config.Logger = logger
+	client.config.LogLevel = LogError
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	m := diam.NewMessage(9999, diam.RequestFlag, 4, 1, 2, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	go func() {
+		m.WriteTo(peer)
+		io.Copy(ioutil.Discard, peer)
+	}()
+
+	select {
+	case err := <-client.ErrorNotify():
+		e, ok := logger.find(LogErrorReported, Command{ApplicationID: 4, Code: 9999})
+		if !ok || e.Level != LogError || e.Err != err {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unsupported request was not reported")
+	}
+	if _, ok := logger.find(LogRequestReceived, Command{ApplicationID: 4, Code: 9999}); ok {
+		t.Error("request logged below LogError")
+	}
+}
@@ -0,0 +1,234 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors of the clients configured with it.
+// One Metrics can be shared by every client of a Pool or Router; the series
+// are labelled with the URL of each peer.
+type Metrics struct {
+	requests    *prometheus.CounterVec
+	answers     *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	watchdogRTT *prometheus.HistogramVec
+	reconnects  *prometheus.CounterVec
+
+	mu      sync.Mutex
+	clients map[*diameterClient]struct{}
+}
+
+// NewMetrics creates the collectors and registers them with registerer.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "diameter",
+			Name:      "requests_sent_total",
+			Help:      "Application requests written to the peer.",
+		}, []string{"peer", "command", "service_context_id"}),
+		answers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "diameter",
+			Name:      "answers_received_total",
+			Help:      "Answers to application requests by Result-Code.",
+		}, []string{"peer", "command", "service_context_id", "result_code", "result_class"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "diameter",
+			Name:      "requests_failed_total",
+			Help:      "Application requests that ended without an answer, by reason.",
+		}, []string{"command", "reason"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "diameter",
+			Name:      "request_duration_seconds",
+			Help:      "Time from writing an application request to reading its answer.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"peer", "command", "service_context_id", "result_class"}),
+		watchdogRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "diameter",
+			Name:      "watchdog_rtt_seconds",
+			Help:      "Time from writing a DWR to reading its DWA.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"peer"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "diameter",
+			Name:      "reconnects_total",
+			Help:      "Reconnection attempts by outcome.",
+		}, []string{"peer", "outcome"}),
+		clients: make(map[*diameterClient]struct{}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.answers, m.failures, m.latency, m.watchdogRTT, m.reconnects, clientCollector{m}} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// MetricsHandler serves the metrics of gatherer, usually the registry passed
+// to NewMetrics, in the Prometheus exposition format.
+func MetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) add(d *diameterClient) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[d] = struct{}{}
+}
+
+func (m *Metrics) remove(d *diameterClient) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.clients, d)
+}
+
+func (m *Metrics) requestSent(d *diameterClient, request *diam.Message) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(d.config.URL, d.commandName(request), serviceContextID(request)).Inc()
+}
+
+func (m *Metrics) answerReceived(d *diameterClient, request, answer *diam.Message, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	command, serviceContext := d.commandName(request), serviceContextID(request)
+	result, _ := ResultOf(answer)
+	class := result.Class().String()
+	m.answers.WithLabelValues(d.config.URL, command, serviceContext, strconv.FormatUint(uint64(result.Code), 10), class).Inc()
+	m.latency.WithLabelValues(d.config.URL, command, serviceContext, class).Observe(latency.Seconds())
+}
+
+// requestFailed counts a request that ended with err instead of an answer.
+// It is called by the Do and Serve methods of the Router, Pool or client the
+// request was made on, whether or not the request is traced, and never by the
+// ones they call in turn, so that each request is counted once.
+func (m *Metrics) requestFailed(config DiameterConfig, request Request, err error) {
+	if m == nil || err == nil {
+		return
+	}
+	m.failures.WithLabelValues(requestName(config, request), failureReason(err)).Inc()
+}
+
+// failureReason is the reason label of err: the Kind of an *Error, such as
+// "timeout" for an expired Tx timer or "transport" for a lost connection, or
+// the cause of the errors that are returned as they are.
+func failureReason(err error) string {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e.Kind.String()
+	case errors.Is(err, ErrNoRoute):
+		return "no route"
+	case errors.Is(err, ErrClientClosed):
+		return "closed"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline exceeded"
+	}
+	return "unknown"
+}
+
+func (m *Metrics) watchdogAnswered(d *diameterClient, rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	m.watchdogRTT.WithLabelValues(d.config.URL).Observe(rtt.Seconds())
+}
+
+func (m *Metrics) reconnected(d *diameterClient, ok bool) {
+	if m == nil {
+		return
+	}
+	outcome := "success"
+	if !ok {
+		outcome = "failure"
+	}
+	m.reconnects.WithLabelValues(d.config.URL, outcome).Inc()
+}
+
+var (
+	inflightDesc = prometheus.NewDesc("diameter_requests_in_flight",
+		"Application requests written and waiting for their answer.", []string{"peer"}, nil)
+	queueDepthDesc = prometheus.NewDesc("diameter_request_queue_depth",
+		"Requests accepted and waiting to be written.", []string{"peer"}, nil)
+	watchdogStateDesc = prometheus.NewDesc("diameter_watchdog_state",
+		"Connections to the peer in each watchdog state.", []string{"peer", "state"}, nil)
+)
+
+var watchdogStates = []WatchdogState{WatchdogInitial, WatchdogOkay, WatchdogSuspect, WatchdogDown, WatchdogReopen}
+
+// clientCollector reads the gauges from the clients when they are scraped.
+type clientCollector struct {
+	metrics *Metrics
+}
+
+func (c clientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- inflightDesc
+	ch <- queueDepthDesc
+	ch <- watchdogStateDesc
+}
+
+func (c clientCollector) Collect(ch chan<- prometheus.Metric) {
+	type gauges struct {
+		inflight, queued int
+		states           map[WatchdogState]int
+	}
+	peers := make(map[string]*gauges)
+
+	c.metrics.mu.Lock()
+	for d := range c.metrics.clients {
+		g, ok := peers[d.config.URL]
+		if !ok {
+			g = &gauges{states: make(map[WatchdogState]int)}
+			peers[d.config.URL] = g
+		}
+		g.inflight += d.pending.len()
+		g.queued += len(d.inCh)
+		g.states[d.WatchdogState()]++
+	}
+	c.metrics.mu.Unlock()
+
+	for peer, g := range peers {
+		ch <- prometheus.MustNewConstMetric(inflightDesc, prometheus.GaugeValue, float64(g.inflight), peer)
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(g.queued), peer)
+		for _, state := range watchdogStates {
+			ch <- prometheus.MustNewConstMetric(watchdogStateDesc, prometheus.GaugeValue, float64(g.states[state]), peer, state.String())
+		}
+	}
+}
+
+func (d *diameterClient) commandName(m *diam.Message) string {
+	if command, err := d.dictionary().FindCommand(m.Header.ApplicationID, m.Header.CommandCode); err == nil {
+		return command.Name
+	}
+	return strconv.FormatUint(uint64(m.Header.CommandCode), 10)
+}
+
+func serviceContextID(m *diam.Message) string {
+	if a, err := m.FindAVP(avp.ServiceContextID); err == nil {
+		if id, ok := a.Data.(datatype.UTF8String); ok {
+			return string(id)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type serviceContextRequest struct {
+	mockRequest
+}
+
+func (r *serviceContextRequest) AVP() []*diam.AVP {
+	return []*diam.AVP{
+		diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org")),
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewTestClient(server.Address)
+	client.config.Metrics = metrics
+	metrics.add(client)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, client, WatchdogOkay)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Do(context.Background(), &serviceContextRequest{mockRequest{outCh: make(chan *diam.Message, 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peer := server.Address
+	if n := testutil.ToFloat64(metrics.requests.WithLabelValues(peer, "Credit-Control", "32251@3gpp.org")); n != 3 {
+		t.Errorf("%v requests sent, want 3", n)
+	}
+	if n := testutil.ToFloat64(metrics.answers.WithLabelValues(peer, "Credit-Control", "32251@3gpp.org", "2001", "success")); n != 3 {
+		t.Errorf("%v answers received, want 3", n)
+	}
+	if n := testutil.CollectAndCount(metrics.latency); n != 1 {
+		t.Errorf("%d latency series, want 1", n)
+	}
+
+	expected := `
+# HELP diameter_watchdog_state Connections to the peer in each watchdog state.
+# TYPE diameter_watchdog_state gauge
+diameter_watchdog_state{peer="` + peer + `",state="DOWN"} 0
+diameter_watchdog_state{peer="` + peer + `",state="INITIAL"} 0
+diameter_watchdog_state{peer="` + peer + `",state="OKAY"} 1
+diameter_watchdog_state{peer="` + peer + `",state="REOPEN"} 0
+diameter_watchdog_state{peer="` + peer + `",state="SUSPECT"} 0
+# HELP diameter_requests_in_flight Application requests written and waiting for their answer.
+# TYPE diameter_requests_in_flight gauge
+diameter_requests_in_flight{peer="` + peer + `"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "diameter_watchdog_state", "diameter_requests_in_flight"); err != nil {
+		t.Error(err)
+	}
+
+	client.Close()
+	if n, err := testutil.GatherAndCount(registry, "diameter_watchdog_state"); err != nil || n != 0 {
+		t.Errorf("closed client still collected: %d series, %v", n, err)
+	}
+}
+
+func TestMetricsCountsFailedRequests(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewTestClient(server.Address)
+	client.config.Metrics = metrics
+	client.config.TxTimeout = 50 * time.Millisecond
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Init(); err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	if _, err := client.Do(context.Background(), &mockRequest{}); !errors.Is(err, ErrTxTimeout) {
+		t.Errorf("expected ErrTxTimeout, got %v", err)
+	}
+	client.Close()
+	if _, err := client.Do(context.Background(), &mockRequest{}); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if err := client.Serve(&mockRequest{}); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+
+	router := NewTestRouter()
+	router.config.Metrics = metrics
+	if _, err := router.Do(context.Background(), &mockRequest{}); err != ErrNoRoute {
+		t.Errorf("expected ErrNoRoute, got %v", err)
+	}
+	if err := router.Serve(&mockRequest{}); err != ErrNoRoute {
+		t.Errorf("expected ErrNoRoute, got %v", err)
+	}
+
+	for reason, want := range map[string]float64{"timeout": 1, "closed": 2, "no route": 2} {
+		if n := testutil.ToFloat64(metrics.failures.WithLabelValues("Credit-Control", reason)); n != want {
+			t.Errorf("%v requests failed with reason %q, want %v", n, reason, want)
+		}
+	}
+}
+
+func TestMetricsRejectsSecondRegistration(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if _, err := NewMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMetrics(registry); err == nil {
+		t.Error("metrics registered twice")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewTestClient("peer:3868")
+	client.config.Metrics = metrics
+	metrics.add(client)
+	metrics.reconnected(client, false)
+
+	server := httptest.NewServer(MetricsHandler(registry))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`diameter_reconnects_total{outcome="failure",peer="peer:3868"} 1`,
+		`diameter_request_queue_depth{peer="peer:3868"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape does not contain %s", want)
+		}
+	}
+}
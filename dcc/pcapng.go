@@ -0,0 +1,268 @@
+package dcc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// PcapngConfig configures a PcapngWriter.
+type PcapngConfig struct {
+	// Path is the file the capture is written to. It is truncated when the
+	// writer is created.
+	Path string
+	// MaxSize rotates the file once writing the next packet would take it
+	// past MaxSize bytes. Zero disables rotation.
+	MaxSize int64
+	// MaxFiles is the number of rotated files kept as Path.1, Path.2 and so
+	// on, the lowest suffix being the newest. It defaults to 1.
+	MaxFiles int
+}
+
+const (
+	pcapngSectionHeader    = 0x0A0D0D0A
+	pcapngInterface        = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngLinkTypeRaw      = 101
+	pcapngHeaderSize       = 28 + 20
+	pcapngMaxSegmentLength = 65535 - 40
+	diameterPort           = 3868
+)
+
+// PcapngWriter is a Tap that writes the tapped messages to a pcapng file that
+// Wireshark can open. Every message is wrapped in synthetic IP and TCP
+// headers between the client address and port 3868 of the peer, so the
+// Diameter dissector picks it up even for TLS connections or peers listening
+// on another port.
+type PcapngWriter struct {
+	config PcapngConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	streams map[string]*pcapngStream
+	ipID    uint16
+	err     error
+}
+
+// pcapngStream holds the next sequence number of each side of a connection.
+type pcapngStream struct {
+	clientSeq, serverSeq uint32
+}
+
+func NewPcapngWriter(config PcapngConfig) (*PcapngWriter, error) {
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = 1
+	}
+	w := &PcapngWriter{
+		config:  config,
+		streams: make(map[string]*pcapngStream),
+	}
+	if err := w.create(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *PcapngWriter) create() error {
+	file, err := os.Create(w.config.Path)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 0, pcapngHeaderSize)
+	b = appendUint32(b, pcapngSectionHeader, 28, pcapngByteOrderMagic)
+	b = appendUint16(b, 1, 0)
+	b = appendUint32(b, 0xFFFFFFFF, 0xFFFFFFFF, 28)
+	b = appendUint32(b, pcapngInterface, 20)
+	b = appendUint16(b, pcapngLinkTypeRaw, 0)
+	b = appendUint32(b, 0, 20)
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = int64(len(b))
+	return nil
+}
+
+func (w *PcapngWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	for i := w.config.MaxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", w.config.Path, i), fmt.Sprintf("%s.%d", w.config.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.config.Path, w.config.Path+".1"); err != nil {
+		return err
+	}
+	return w.create()
+}
+
+// Tap writes m as one packet, or as several when it does not fit in one IP
+// packet. Write errors stop the capture and are returned by Close.
+func (w *PcapngWriter) Tap(m TappedMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+
+	client := tcpEndpoint(m.LocalAddr, net.IPv4(127, 0, 0, 1), 49152)
+	server := tcpEndpoint(m.RemoteAddr, net.IPv4(127, 0, 0, 2), diameterPort)
+	server.Port = diameterPort
+	if client.IP.To4() == nil || server.IP.To4() == nil {
+		client.IP, server.IP = client.IP.To16(), server.IP.To16()
+	} else {
+		client.IP, server.IP = client.IP.To4(), server.IP.To4()
+	}
+
+	key := client.String() + "-" + server.String()
+	stream, ok := w.streams[key]
+	if !ok {
+		stream = &pcapngStream{clientSeq: 1, serverSeq: 1}
+		w.streams[key] = stream
+	}
+
+	for payload := m.Raw; len(payload) > 0; {
+		segment := payload
+		if len(segment) > pcapngMaxSegmentLength {
+			segment = segment[:pcapngMaxSegmentLength]
+		}
+		payload = payload[len(segment):]
+
+		var packet []byte
+		if m.Direction == Outbound {
+			packet = w.packet(client, server, stream.clientSeq, stream.serverSeq, segment)
+			stream.clientSeq += uint32(len(segment))
+		} else {
+			packet = w.packet(server, client, stream.serverSeq, stream.clientSeq, segment)
+			stream.serverSeq += uint32(len(segment))
+		}
+
+		padded := (len(packet) + 3) &^ 3
+		blockLength := uint32(32 + padded)
+		micros := uint64(m.Time.UnixNano() / 1000)
+		b := make([]byte, 0, blockLength)
+		b = appendUint32(b, pcapngEnhancedPacket, blockLength, 0, uint32(micros>>32), uint32(micros), uint32(len(packet)), uint32(len(packet)))
+		b = append(b, packet...)
+		b = append(b, make([]byte, padded-len(packet))...)
+		b = appendUint32(b, blockLength)
+
+		if w.config.MaxSize > 0 && w.size > pcapngHeaderSize && w.size+int64(len(b)) > w.config.MaxSize {
+			if w.err = w.rotate(); w.err != nil {
+				return
+			}
+		}
+		if _, w.err = w.file.Write(b); w.err != nil {
+			return
+		}
+		w.size += int64(len(b))
+	}
+}
+
+func (w *PcapngWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return w.err
+	}
+	err := w.file.Close()
+	w.file = nil
+	if w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func tcpEndpoint(addr net.Addr, ip net.IP, port int) net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+	return net.TCPAddr{IP: ip, Port: port}
+}
+
+// packet builds an IPv4 or IPv6 packet holding a TCP segment with the PSH
+// and ACK flags set.
+func (w *PcapngWriter) packet(src, dst net.TCPAddr, seq, ack uint32, payload []byte) []byte {
+	tcp := make([]byte, 0, 20+len(payload))
+	tcp = appendUint16BE(tcp, uint16(src.Port), uint16(dst.Port))
+	tcp = appendUint32BE(tcp, seq, ack)
+	tcp = append(tcp, 5<<4, 0x18)
+	tcp = appendUint16BE(tcp, 65535, 0, 0)
+	tcp = append(tcp, payload...)
+
+	var pseudo, ip []byte
+	if len(src.IP) == net.IPv4len {
+		pseudo = append(append(append(pseudo, src.IP...), dst.IP...), 0, 6)
+		pseudo = appendUint16BE(pseudo, uint16(len(tcp)))
+
+		w.ipID++
+		ip = append(ip, 0x45, 0)
+		ip = appendUint16BE(ip, uint16(20+len(tcp)), w.ipID, 0x4000)
+		ip = append(ip, 64, 6, 0, 0)
+		ip = append(append(ip, src.IP...), dst.IP...)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	} else {
+		pseudo = append(append(pseudo, src.IP...), dst.IP...)
+		pseudo = appendUint32BE(pseudo, uint32(len(tcp)), 6)
+
+		ip = appendUint32BE(ip, 6<<28)
+		ip = appendUint16BE(ip, uint16(len(tcp)))
+		ip = append(ip, 6, 64)
+		ip = append(append(ip, src.IP...), dst.IP...)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+	return append(ip, tcp...)
+}
+
+// checksum is the Internet checksum of RFC 1071.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// The pcapng blocks are written in little-endian byte order, the packets in
+// network byte order.
+
+func appendUint16(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v), byte(v>>8))
+	}
+	return b
+}
+
+func appendUint32(b []byte, values ...uint32) []byte {
+	for _, v := range values {
+		b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+	return b
+}
+
+func appendUint16BE(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func appendUint32BE(b []byte, values ...uint32) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return b
+}
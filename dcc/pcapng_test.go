@@ -0,0 +1,191 @@
+package dcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPcapngBlocks(t *testing.T, path string) []pcapngBlock {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block in %s", path)
+		}
+		length := binary.LittleEndian.Uint32(b[4:])
+		if length%4 != 0 || int(length) > len(b) || binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("bad block length %d in %s", length, path)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(b), b[8 : length-4]})
+		b = b[length:]
+	}
+	return blocks
+}
+
+// packetOf returns the captured packet of an Enhanced Packet Block.
+func packetOf(t *testing.T, block pcapngBlock) []byte {
+	if block.blockType != pcapngEnhancedPacket {
+		t.Fatalf("block type %#x, want an Enhanced Packet Block", block.blockType)
+	}
+	length := binary.LittleEndian.Uint32(block.body[12:])
+	return block.body[20 : 20+length]
+}
+
+func tappedMessage(direction Direction, raw []byte, local, remote string) TappedMessage {
+	localAddr, _ := net.ResolveTCPAddr("tcp", local)
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", remote)
+	return TappedMessage{
+		Direction:  direction,
+		Time:       time.Unix(1500000000, 123456000),
+		Raw:        raw,
+		LocalAddr:  localAddr,
+		RemoteAddr: remoteAddr,
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcapng")
+
+	w, err := NewPcapngWriter(PcapngConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := bytes.Repeat([]byte{1}, 21)
+	answer := bytes.Repeat([]byte{2}, 40)
+	w.Tap(tappedMessage(Outbound, request, "10.0.0.1:40000", "10.0.0.2:3870"))
+	w.Tap(tappedMessage(Inbound, answer, "10.0.0.1:40000", "10.0.0.2:3870"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readPcapngBlocks(t, path)
+	if len(blocks) != 4 {
+		t.Fatalf("%d blocks, want 4", len(blocks))
+	}
+	if blocks[0].blockType != pcapngSectionHeader || binary.LittleEndian.Uint32(blocks[0].body) != pcapngByteOrderMagic {
+		t.Error("file does not start with a Section Header Block")
+	}
+	if blocks[1].blockType != pcapngInterface || binary.LittleEndian.Uint16(blocks[1].body) != pcapngLinkTypeRaw {
+		t.Error("missing raw IP Interface Description Block")
+	}
+	timestamp := uint64(binary.LittleEndian.Uint32(blocks[2].body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(blocks[2].body[8:]))
+	if timestamp != 1500000000123456 {
+		t.Errorf("timestamp %d", timestamp)
+	}
+
+	for i, c := range []struct {
+		payload          []byte
+		src, dst         string
+		srcPort, dstPort uint16
+		seq, ack         uint32
+	}{
+		{request, "10.0.0.1", "10.0.0.2", 40000, 3868, 1, 1},
+		{answer, "10.0.0.2", "10.0.0.1", 3868, 40000, 1, 22},
+	} {
+		packet := packetOf(t, blocks[2+i])
+		ip, tcp := packet[:20], packet[20:]
+		if ip[0] != 0x45 || ip[9] != 6 || int(binary.BigEndian.Uint16(ip[2:])) != len(packet) {
+			t.Errorf("packet %d: bad IPv4 header % x", i, ip)
+		}
+		if checksum(ip) != 0 {
+			t.Errorf("packet %d: bad IPv4 checksum", i)
+		}
+		if !net.IP(ip[12:16]).Equal(net.ParseIP(c.src)) || !net.IP(ip[16:20]).Equal(net.ParseIP(c.dst)) {
+			t.Errorf("packet %d: addresses %v -> %v", i, net.IP(ip[12:16]), net.IP(ip[16:20]))
+		}
+		if binary.BigEndian.Uint16(tcp) != c.srcPort || binary.BigEndian.Uint16(tcp[2:]) != c.dstPort {
+			t.Errorf("packet %d: ports %d -> %d", i, binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:]))
+		}
+		if binary.BigEndian.Uint32(tcp[4:]) != c.seq || binary.BigEndian.Uint32(tcp[8:]) != c.ack {
+			t.Errorf("packet %d: seq %d ack %d", i, binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:]))
+		}
+		pseudo := append(append(append([]byte{}, ip[12:20]...), 0, 6), byte(len(tcp)>>8), byte(len(tcp)))
+		if checksum(append(pseudo, tcp...)) != 0 {
+			t.Errorf("packet %d: bad TCP checksum", i)
+		}
+		if !bytes.Equal(tcp[20:], c.payload) {
+			t.Errorf("packet %d: payload differs", i)
+		}
+	}
+}
+
+func TestPcapngWriterIPv6(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcapng")
+
+	w, err := NewPcapngWriter(PcapngConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Tap(tappedMessage(Outbound, []byte{1, 2, 3}, "[::1]:40000", "[::1]:3868"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := packetOf(t, readPcapngBlocks(t, path)[2])
+	ip, tcp := packet[:40], packet[40:]
+	if ip[0]>>4 != 6 || ip[6] != 6 || int(binary.BigEndian.Uint16(ip[4:])) != len(tcp) {
+		t.Errorf("bad IPv6 header % x", ip)
+	}
+	pseudo := append(append([]byte{}, ip[8:40]...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	if checksum(append(pseudo, tcp...)) != 0 {
+		t.Error("bad TCP checksum")
+	}
+}
+
+func TestPcapngWriterRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcapng")
+
+	w, err := NewPcapngWriter(PcapngConfig{Path: path, MaxSize: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= 4; i++ {
+		w.Tap(tappedMessage(Outbound, bytes.Repeat([]byte{i}, 100), "10.0.0.1:40000", "10.0.0.2:3868"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file holds one packet: the newest in path, the oldest dropped.
+	for suffix, want := range map[string]byte{"": 4, ".1": 3, ".2": 2} {
+		blocks := readPcapngBlocks(t, path+suffix)
+		if len(blocks) != 3 || blocks[0].blockType != pcapngSectionHeader {
+			t.Fatalf("%s%s: %d blocks", path, suffix, len(blocks))
+		}
+		if payload := packetOf(t, blocks[2])[40:]; payload[0] != want {
+			t.Errorf("%s%s holds packet %d, want %d", path, suffix, payload[0], want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("more rotated files than MaxFiles")
+	}
+}
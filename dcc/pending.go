@@ -0,0 +1,155 @@
+package dcc
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+type transactionKey struct {
+	hopByHopID uint32
+	endToEndID uint32
+}
+
+func messageKey(m *diam.Message) transactionKey {
+	return transactionKey{
+		hopByHopID: m.Header.HopByHopID,
+		endToEndID: m.Header.EndToEndID,
+	}
+}
+
+type transaction struct {
+	ctx     context.Context
+	request Request
+
+	// key and abandoned are guarded by the pendingTable mutex.
+	key       transactionKey
+	abandoned bool
+
+	// sessionID is chosen before the transaction is queued, so that errors
+	// can name it whether or not the request was written.
+	sessionID datatype.UTF8String
+	// destinationHost is the Destination-Host of the request, empty to leave
+	// it out. It is set by whoever picked the peer: the client itself, or the
+	// Pool whose route the peer serves.
+	destinationHost datatype.DiameterIdentity
+
+	// deadline is when the Tx timer expires. It runs from the moment the
+	// request is queued, so that neither a full queue nor a peer that is not
+	// ready holds the caller beyond it.
+	deadline time.Time
+
+	// message is the request as it was last written. When it is set before
+	// the transaction is queued, the request is sent again with its
+	// End-to-End identifier instead of built from scratch, and with the T
+	// flag when retransmit is set, as after a link failover.
+	message    *diam.Message
+	retransmit bool
+	// sent is when message was written, for the latency of the answer.
+	sent time.Time
+
+	answerCh chan *diam.Message
+	errorCh  chan error
+}
+
+func newTransaction(ctx context.Context, request Request) *transaction {
+	return &transaction{
+		ctx:      ctx,
+		request:  request,
+		answerCh: make(chan *diam.Message, 1),
+		errorCh:  make(chan error, 1),
+	}
+}
+
+func (t *transaction) answerNotify() <-chan *diam.Message {
+	return t.answerCh
+}
+
+func (t *transaction) errorNotify() <-chan error {
+	return t.errorCh
+}
+
+type pendingTable struct {
+	mu           sync.Mutex
+	transactions map[transactionKey]*transaction
+}
+
+func newPendingTable() *pendingTable {
+	return &pendingTable{
+		transactions: make(map[transactionKey]*transaction),
+	}
+}
+
+func (p *pendingTable) add(t *transaction, key transactionKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t.abandoned {
+		return false
+	}
+	t.key = key
+	p.transactions[key] = t
+	return true
+}
+
+func (p *pendingTable) remove(key transactionKey) (*transaction, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.transactions[key]
+	if ok {
+		delete(p.transactions, key)
+	}
+	return t, ok
+}
+
+func (p *pendingTable) abandon(t *transaction) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t.abandoned = true
+	if p.transactions[t.key] == t {
+		delete(p.transactions, t.key)
+	}
+}
+
+func (p *pendingTable) failAll(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, t := range p.transactions {
+		delete(p.transactions, key)
+		t.errorCh <- err
+	}
+}
+
+func (p *pendingTable) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.transactions)
+}
+
+// identifiers hands out Hop-by-Hop and End-to-End identifiers as described
+// in RFC 6733 section 3: both increase monotonically, and the End-to-End
+// identifier starts with the low 12 bits of the current time so that it
+// stays unique across restarts.
+type identifiers struct {
+	hopByHopID uint32
+	endToEndID uint32
+}
+
+func newIdentifiers() *identifiers {
+	now := uint32(time.Now().Unix())
+	return &identifiers{
+		hopByHopID: rand.Uint32(),
+		endToEndID: now<<20 | rand.Uint32()&0xfffff,
+	}
+}
+
+func (i *identifiers) next() transactionKey {
+	return transactionKey{
+		hopByHopID: atomic.AddUint32(&i.hopByHopID, 1),
+		endToEndID: atomic.AddUint32(&i.endToEndID, 1),
+	}
+}
@@ -0,0 +1,587 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type BalancePolicy int
+
+const (
+	RoundRobin BalancePolicy = iota
+	LeastOutstanding
+	Weighted
+)
+
+// PoolConfig configures a Pool. The embedded DiameterConfig holds the
+// settings shared by every peer; its URL and DestinationHost are replaced by
+// those of each PeerConfig.
+type PoolConfig struct {
+	DiameterConfig
+	Peers  []PeerConfig
+	Policy BalancePolicy
+}
+
+type PeerConfig struct {
+	URL             string
+	DestinationHost datatype.DiameterIdentity
+	// Weight is only used by the Weighted policy. Zero counts as 1.
+	Weight int
+	// Priority orders peers for failover: only the OKAY peers with the lowest
+	// Priority take traffic, so a higher value marks a standby that is used
+	// while every primary is down.
+	Priority int
+}
+
+// Pool keeps a connection, with its own capabilities exchange and watchdog,
+// to each configured peer and spreads requests over the peers whose watchdog
+// is OKAY. When no peer is OKAY the request is queued on the peer chosen by
+// the policy and sent once that peer is ready or its Tx timer expires.
+//
+// Requests that were pending or queued on a peer whose connection fails or
+// whose watchdog turns SUSPECT are resent to another peer, with the T flag and
+// the original End-to-End identifier if they had already been written. So
+// are requests whose Tx timer expires, when another peer is OKAY.
+//
+// Every Session-Id is pinned to the peer that answered its first request, so
+// that the updates and the termination of a credit-control session reach
+// the server holding its reservation. A session only moves to another peer
+// when its own is not OKAY or fails while the request is outstanding.
+type Pool struct {
+	config DiameterConfig
+
+	// peers is replaced, never modified, by Reload. subscribers are the
+	// channels of Subscribe, which the peers added by Reload send to.
+	peersMu     sync.RWMutex
+	peers       []*poolPeer
+	subscribers []chan Event
+	reloadMu    sync.Mutex
+
+	// mu guards policy, next, sessions and the weight, priority and current
+	// of the peers.
+	mu       sync.Mutex
+	policy   BalancePolicy
+	next     int
+	sessions map[datatype.UTF8String]*sessionPin
+	swept    time.Time
+
+	// clients, if set, shares the clients of the pool with the other routes
+	// of a Router.
+	clients *peerSet
+
+	errorCh chan error
+
+	acceptMu sync.RWMutex
+	closing  bool
+	inflight sync.WaitGroup
+}
+
+type poolPeer struct {
+	client *diameterClient
+	// destinationHost is the Destination-Host of the requests sent to the
+	// peer, empty for the routes of a Router that relay them.
+	destinationHost datatype.DiameterIdentity
+	weight          int
+	priority        int
+	current         int
+	outstanding     int64
+	// removed is set once Reload took the peer out of the pool.
+	removed int32
+
+	// shared is the set of a Router the client was acquired from, and
+	// released is set once the peer gave it back. starts is set on the peer
+	// that connects the client: every peer of a standalone Pool, and the
+	// first one to acquire a shared client.
+	shared   *peerSet
+	released int32
+	starts   bool
+}
+
+// sessionIdleTimeout is how long a Session-Id stays pinned to its peer after
+// its last request, for sessions that never send their termination.
+const sessionIdleTimeout = time.Hour
+
+// sessionPin is the peer a session is bound to.
+type sessionPin struct {
+	peer *poolPeer
+	used time.Time
+}
+
+func NewPool(config PoolConfig) *Pool {
+	return newPool(config, nil)
+}
+
+// newPool creates a Pool whose clients are acquired from clients, if set.
+func newPool(config PoolConfig, clients *peerSet) *Pool {
+	shared := config.DiameterConfig
+	if shared.SessionIDGenerator == nil {
+		shared.SessionIDGenerator = NewSessionIDGenerator(shared.OriginHost, uint32(time.Now().Unix()), "")
+	}
+
+	p := &Pool{
+		config:   shared,
+		policy:   config.Policy,
+		sessions: make(map[datatype.UTF8String]*sessionPin),
+		clients:  clients,
+		errorCh:  make(chan error, 10),
+	}
+	for _, peer := range config.Peers {
+		p.peers = append(p.peers, p.newPeer(peer))
+	}
+	return p
+}
+
+func (p *Pool) newPeer(peer PeerConfig) *poolPeer {
+	weight := peer.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	pp := &poolPeer{
+		destinationHost: peer.DestinationHost,
+		weight:          weight,
+		priority:        peer.Priority,
+		shared:          p.clients,
+		starts:          true,
+	}
+	if p.clients != nil {
+		pp.client, pp.starts = p.clients.acquire(peer)
+		return pp
+	}
+	c := p.config
+	c.URL = peer.URL
+	c.DestinationHost = peer.DestinationHost
+	pp.client = NewClient(c)
+	pp.client.failover = true
+	return pp
+}
+
+func (p *Pool) peerList() []*poolPeer {
+	p.peersMu.RLock()
+	defer p.peersMu.RUnlock()
+	return p.peers
+}
+
+// Start connects to every peer. Peers that cannot be reached keep retrying in
+// the background; Start only fails when none of them could be connected.
+func (p *Pool) Start() error {
+	var lastErr error
+	connected := 0
+	for _, peer := range p.peerList() {
+		if err := peer.connect(); err != nil {
+			lastErr = err
+			peer.client.keepConnecting()
+			continue
+		}
+		connected++
+	}
+	if connected == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+// connect connects the client of the peer, unless another pool of the Router
+// does.
+func (peer *poolPeer) connect() error {
+	if !peer.starts {
+		return nil
+	}
+	if err := peer.client.Start(); err != nil {
+		return err
+	}
+	if err := peer.client.Init(); err != nil {
+		peer.client.connection().Close()
+		return err
+	}
+	return nil
+}
+
+func (p *Pool) ErrorNotify() <-chan error {
+	return p.errorCh
+}
+
+// Subscribe returns a channel that receives the Events of every peer,
+// including those added later by Reload.
+func (p *Pool) Subscribe() <-chan Event {
+	ch := make(chan Event, 10)
+	p.subscribe(ch)
+	return ch
+}
+
+func (p *Pool) subscribe(ch chan Event) {
+	p.peersMu.Lock()
+	defer p.peersMu.Unlock()
+	p.subscribers = append(p.subscribers, ch)
+	for _, peer := range p.peers {
+		peer.client.subscribe(ch)
+	}
+}
+
+// release gives a shared client back to its set, once. It reports whether
+// the client is to be stopped: it is not shared, or nothing else uses it.
+func (peer *poolPeer) release() bool {
+	if peer.shared == nil {
+		return true
+	}
+	if !atomic.CompareAndSwapInt32(&peer.released, 0, 1) {
+		return false
+	}
+	return peer.shared.release(peer.client)
+}
+
+func (peer *poolPeer) shutdown(ctx context.Context) error {
+	if !peer.release() {
+		return nil
+	}
+	return peer.client.Shutdown(ctx)
+}
+
+func (peer *poolPeer) close() {
+	if peer.release() {
+		peer.client.Close()
+	}
+}
+
+func (p *Pool) Serve(request Request) error {
+	return p.ServeContext(context.Background(), request)
+}
+
+// ServeContext is Serve for a request made on behalf of ctx, as for a client.
+func (p *Pool) ServeContext(ctx context.Context, request Request) error {
+	if !p.accept() {
+		p.config.Metrics.requestFailed(p.config, request, ErrClientClosed)
+		return ErrClientClosed
+	}
+	ctx, end := startSpan(context.WithoutCancel(ctx), p.config, request)
+	go func() {
+		defer p.inflight.Done()
+		_, m, err := p.do(newTransaction(ctx, request))
+		end(m, err)
+		if err != nil {
+			p.config.Metrics.requestFailed(p.config, request, err)
+			fail(request, p.config.ErrorHandler, p.errorCh, err)
+			return
+		}
+		request.Response(m)
+	}()
+	return nil
+}
+
+func (p *Pool) Do(ctx context.Context, request Request) (*diam.Message, error) {
+	_, m, err := p.route(ctx, request)
+	p.config.Metrics.requestFailed(p.config, request, err)
+	return m, err
+}
+
+// route is Do for a Router. It also returns the transaction that was sent
+// last, so that a redirected request keeps its Session-Id and End-to-End
+// identifier.
+func (p *Pool) route(ctx context.Context, request Request) (*transaction, *diam.Message, error) {
+	if !p.accept() {
+		return nil, nil, ErrClientClosed
+	}
+	defer p.inflight.Done()
+	ctx, end := startSpan(ctx, p.config, request)
+	t, m, err := p.do(newTransaction(ctx, request))
+	end(m, err)
+	return t, m, err
+}
+
+// redirect sends t to peer, as the Redirect-Host of an answer, and fails it
+// over to the other peers of the pool like Do.
+func (p *Pool) redirect(t *transaction, peer *poolPeer) (*diam.Message, error) {
+	if !p.accept() {
+		return nil, ErrClientClosed
+	}
+	defer p.inflight.Done()
+	p.bind(t.sessionID, peer, false)
+	_, m, err := p.do(t)
+	return m, err
+}
+
+// do sends t to a peer, and again to another one on failover, in a new
+// transaction that is returned.
+func (p *Pool) do(t *transaction) (*transaction, *diam.Message, error) {
+	ctx, request := t.ctx, t.request
+	if t.sessionID == "" {
+		t.sessionID = nextSessionID(request, p.config.SessionIDGenerator)
+	}
+	tried := make(map[*poolPeer]bool)
+	var m *diam.Message
+	var err error = ErrClientClosed
+	for {
+		peer := p.pick(t.sessionID, tried)
+		if peer == nil {
+			return t, m, err
+		}
+		tried[peer] = true
+		m, err = peer.do(t)
+		if err == nil {
+			p.bind(t.sessionID, peer, sessionEnds(request))
+		}
+		// A peer that Reload removed refuses the requests that picked it
+		// just before it was taken out of the pool.
+		removed := errors.Is(err, ErrClientClosed) && atomic.LoadInt32(&peer.removed) == 1
+		if !failsOver(err) && !removed || errors.Is(err, ErrTxTimeout) && !p.alternate(tried) {
+			return t, m, err
+		}
+		trace.SpanFromContext(ctx).AddEvent("failover", trace.WithAttributes(
+			attribute.String("diameter.peer", peer.client.peerName()),
+			attribute.String("error", err.Error()),
+		))
+
+		next := newTransaction(ctx, request)
+		next.sessionID = t.sessionID
+		next.message = t.message
+		next.retransmit = true
+		t = next
+	}
+}
+
+// alternate reports whether a peer other than those in exclude is OKAY.
+func (p *Pool) alternate(exclude map[*poolPeer]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.candidates(exclude, true)) > 0
+}
+
+// failsOver reports whether a request that failed with err is resent to
+// another peer: its connection was lost, its watchdog turned SUSPECT or its
+// Tx timer expired.
+func failsOver(err error) bool {
+	return errors.Is(err, ErrConnectionLost) || errors.Is(err, ErrPeerSuspect) || errors.Is(err, ErrTxTimeout)
+}
+
+func (peer *poolPeer) do(t *transaction) (*diam.Message, error) {
+	t.destinationHost = peer.destinationHost
+	atomic.AddInt64(&peer.outstanding, 1)
+	defer atomic.AddInt64(&peer.outstanding, -1)
+	return peer.client.do(t)
+}
+
+func (p *Pool) accept() bool {
+	p.acceptMu.RLock()
+	defer p.acceptMu.RUnlock()
+	if p.closing || len(p.peerList()) == 0 {
+		return false
+	}
+	p.inflight.Add(1)
+	return true
+}
+
+// pick chooses a peer other than those in exclude: the one sessionID is
+// pinned to if it is OKAY, else one chosen by the policy. It returns nil when
+// every peer of the pool is excluded.
+func (p *Pool) pick(sessionID datatype.UTF8String, exclude map[*poolPeer]bool) *poolPeer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pin, ok := p.sessions[sessionID]; ok {
+		peer := pin.peer
+		if !exclude[peer] && atomic.LoadInt32(&peer.removed) == 0 && peer.client.WatchdogState() == WatchdogOkay {
+			return peer
+		}
+	}
+	candidates := p.candidates(exclude, true)
+	if len(candidates) == 0 {
+		candidates = p.candidates(exclude, false)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case LeastOutstanding:
+		best := candidates[p.next%len(candidates)]
+		for _, peer := range candidates {
+			if atomic.LoadInt64(&peer.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = peer
+			}
+		}
+		p.next++
+		return best
+	case Weighted:
+		// Smooth weighted round-robin, as in nginx: every candidate gains its
+		// weight, the richest one is picked and pays back the total.
+		var best *poolPeer
+		total := 0
+		for _, peer := range candidates {
+			peer.current += peer.weight
+			total += peer.weight
+			if best == nil || peer.current > best.current {
+				best = peer
+			}
+		}
+		best.current -= total
+		return best
+	default:
+		peer := candidates[p.next%len(candidates)]
+		p.next++
+		return peer
+	}
+}
+
+// bind pins sessionID to the peer that answered its request, or unpins it
+// when the request ended the session.
+func (p *Pool) bind(sessionID datatype.UTF8String, peer *poolPeer, ends bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if ends {
+		delete(p.sessions, sessionID)
+	} else if pin, ok := p.sessions[sessionID]; ok {
+		pin.peer, pin.used = peer, now
+	} else {
+		p.sessions[sessionID] = &sessionPin{peer: peer, used: now}
+	}
+	if now.Sub(p.swept) < sessionIdleTimeout {
+		return
+	}
+	for id, pin := range p.sessions {
+		if now.Sub(pin.used) >= sessionIdleTimeout {
+			delete(p.sessions, id)
+		}
+	}
+	p.swept = now
+}
+
+// candidates returns the peers with the lowest priority among those that are
+// not excluded and, if okay is set, whose watchdog is OKAY.
+func (p *Pool) candidates(exclude map[*poolPeer]bool, okay bool) []*poolPeer {
+	var peers []*poolPeer
+	for _, peer := range p.peerList() {
+		if exclude[peer] || okay && peer.client.WatchdogState() != WatchdogOkay {
+			continue
+		}
+		switch {
+		case len(peers) == 0 || peer.priority == peers[0].priority:
+			peers = append(peers, peer)
+		case peer.priority < peers[0].priority:
+			peers = []*poolPeer{peer}
+		}
+	}
+	return peers
+}
+
+// Shutdown stops accepting requests, waits for the outstanding ones and then
+// shuts every peer down concurrently, as diameterClient.Shutdown does.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.acceptMu.Lock()
+	p.closing = true
+	p.acceptMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		p.Close()
+		return ctx.Err()
+	}
+
+	return shutdownPeers(ctx, p.peerList())
+}
+
+// shutdownPeers shuts peers down concurrently and returns the first error.
+func shutdownPeers(ctx context.Context, peers []*poolPeer) error {
+	errCh := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer *poolPeer) {
+			errCh <- peer.shutdown(ctx)
+		}(peer)
+	}
+	var err error
+	for range peers {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (p *Pool) Close() {
+	p.acceptMu.Lock()
+	p.closing = true
+	p.acceptMu.Unlock()
+
+	for _, peer := range p.peerList() {
+		peer.close()
+	}
+}
+
+// peerSet shares the client of each peer URL between the pools of a Router,
+// so that routes listing the same peer use one connection, capabilities
+// exchange and watchdog. The first route to list a peer sets the
+// DestinationHost of its client.
+type peerSet struct {
+	config DiameterConfig
+
+	mu          sync.Mutex
+	clients     map[string]*sharedClient
+	subscribers []chan Event
+}
+
+type sharedClient struct {
+	client *diameterClient
+	refs   int
+}
+
+func newPeerSet(config DiameterConfig) *peerSet {
+	return &peerSet{config: config, clients: make(map[string]*sharedClient)}
+}
+
+// acquire returns the client of peer, and whether it was created by this
+// call.
+func (s *peerSet) acquire(peer PeerConfig) (*diameterClient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clients[peer.URL]; ok {
+		c.refs++
+		return c.client, false
+	}
+	config := s.config
+	config.URL = peer.URL
+	config.DestinationHost = peer.DestinationHost
+	client := NewClient(config)
+	client.failover = true
+	for _, ch := range s.subscribers {
+		client.subscribe(ch)
+	}
+	s.clients[peer.URL] = &sharedClient{client: client, refs: 1}
+	return client, true
+}
+
+// release drops a reference to client and reports whether it was the last.
+func (s *peerSet) release(client *diameterClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[client.config.URL]
+	if !ok || c.client != client {
+		return false
+	}
+	if c.refs--; c.refs > 0 {
+		return false
+	}
+	delete(s.clients, client.config.URL)
+	return true
+}
+
+func (s *peerSet) subscribe(ch chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, ch)
+	for _, c := range s.clients {
+		c.client.subscribe(ch)
+	}
+}
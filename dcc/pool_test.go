@@ -0,0 +1,499 @@
+package dcc
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+func NewTestPool(policy BalancePolicy, peers ...PeerConfig) *Pool {
+	return NewPool(PoolConfig{
+		DiameterConfig: DiameterConfig{
+			OriginHost:       datatype.DiameterIdentity("client"),
+			OriginRealm:      datatype.DiameterIdentity("localhost"),
+			DestinationRealm: datatype.DiameterIdentity("localhost"),
+			VendorID:         datatype.Unsigned32(0),
+			ProductName:      datatype.UTF8String("go-diameter"),
+			FirmwareRevision: datatype.Unsigned32(1),
+			WatchdogInterval: 100 * time.Millisecond,
+
+			ReconnectInterval:    10 * time.Millisecond,
+			MaxReconnectInterval: 100 * time.Millisecond,
+		},
+		Peers:  peers,
+		Policy: policy,
+	})
+}
+
+func (s *Server) CountCCR() *int32 {
+	var count int32
+	s.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		atomic.AddInt32(&count, 1)
+		s.HandleCCR()(conn, m)
+	}))
+	return &count
+}
+
+func waitForPoolState(t *testing.T, p *Pool, state WatchdogState) {
+	for _, peer := range p.peerList() {
+		deadline := time.Now().Add(2 * time.Second)
+		for peer.client.WatchdogState() != state {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s on %s", state, peer.client.config.URL)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	var servers []*Server
+	var counts []*int32
+	var peers []PeerConfig
+	for i := 0; i < 3; i++ {
+		server := NewTestServer()
+		defer server.Close()
+		servers = append(servers, server)
+		counts = append(counts, server.CountCCR())
+		peers = append(peers, PeerConfig{URL: server.Address, DestinationHost: "srv"})
+	}
+
+	pool := NewTestPool(RoundRobin, peers...)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	for i := 0; i < 6; i++ {
+		if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, count := range counts {
+		if n := atomic.LoadInt32(count); n != 2 {
+			t.Errorf("server %d received %d CCRs, want 2", i, n)
+		}
+	}
+}
+
+func TestPoolWeighted(t *testing.T) {
+	pool := NewTestPool(Weighted,
+		PeerConfig{URL: "a", Weight: 3},
+		PeerConfig{URL: "b", Weight: 1},
+	)
+	for _, peer := range pool.peers {
+		peer.client.watchdog.state = WatchdogOkay
+	}
+
+	picked := map[string]int{}
+	for i := 0; i < 8; i++ {
+		picked[pool.pick("", nil).client.config.URL]++
+	}
+	if picked["a"] != 6 || picked["b"] != 2 {
+		t.Errorf("unexpected distribution %v", picked)
+	}
+}
+
+func TestPoolLeastOutstanding(t *testing.T) {
+	pool := NewTestPool(LeastOutstanding,
+		PeerConfig{URL: "a"},
+		PeerConfig{URL: "b"},
+		PeerConfig{URL: "c"},
+	)
+	for _, peer := range pool.peers {
+		peer.client.watchdog.state = WatchdogOkay
+	}
+	pool.peers[0].outstanding = 4
+	pool.peers[1].outstanding = 1
+	pool.peers[2].outstanding = 2
+
+	for i := 0; i < 3; i++ {
+		if url := pool.pick("", nil).client.config.URL; url != "b" {
+			t.Errorf("picked %s, want b", url)
+		}
+	}
+}
+
+func TestPoolSkipsPeersThatAreNotOkay(t *testing.T) {
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: "a"},
+		PeerConfig{URL: "b"},
+		PeerConfig{URL: "c"},
+	)
+	pool.peers[0].client.watchdog.state = WatchdogSuspect
+	pool.peers[1].client.watchdog.state = WatchdogOkay
+	pool.peers[2].client.watchdog.state = WatchdogDown
+
+	for i := 0; i < 4; i++ {
+		if url := pool.pick("", nil).client.config.URL; url != "b" {
+			t.Errorf("picked %s, want b", url)
+		}
+	}
+}
+
+func TestPoolRoutesAroundLostPeer(t *testing.T) {
+	lost := NewTestServer()
+	healthy := NewTestServer()
+	defer healthy.Close()
+	count := healthy.CountCCR()
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: lost.Address, DestinationHost: "srv"},
+		PeerConfig{URL: healthy.Address, DestinationHost: "srv"},
+	)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	lost.Close()
+	lost.Conn().Close()
+	waitForState(t, pool.peers[0].client, WatchdogDown)
+
+	for i := 0; i < 4; i++ {
+		if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(count); n != 4 {
+		t.Errorf("healthy peer received %d CCRs, want 4", n)
+	}
+}
+
+func TestPoolStartsWithUnreachablePeer(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: "127.0.0.1:1", DestinationHost: "down"},
+		PeerConfig{URL: server.Address, DestinationHost: "srv"},
+	)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	waitForState(t, pool.peers[1].client, WatchdogOkay)
+	if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolShutdown(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	pool := NewTestPool(RoundRobin, PeerConfig{URL: server.Address, DestinationHost: "srv"})
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Serve(&mockRequest{outCh: make(chan *diam.Message, 1)}); err != ErrClientClosed {
+		t.Errorf("Serve after Shutdown returned %v", err)
+	}
+}
+
+func TestPoolRetransmitsPendingRequestOnFailover(t *testing.T) {
+	primary := NewTestServer()
+	defer primary.Close()
+	lostCh := make(chan *diam.Message, 1)
+	primary.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		lostCh <- m
+		conn.Close()
+	}))
+
+	secondary := NewTestServer()
+	defer secondary.Close()
+	retransmittedCh := make(chan *diam.Message, 1)
+	secondary.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		retransmittedCh <- m
+		secondary.HandleCCR()(conn, m)
+	}))
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: primary.Address, DestinationHost: "primary"},
+		PeerConfig{URL: secondary.Address, DestinationHost: "secondary", Priority: 1},
+	)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	request := &numberedRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, number: 7}
+	if _, err := pool.Do(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+
+	lost := <-lostCh
+	retransmitted := <-retransmittedCh
+	if lost.Header.CommandFlags&diam.RetransmittedFlag != 0 {
+		t.Error("first transmission has the T flag set")
+	}
+	if retransmitted.Header.CommandFlags&diam.RetransmittedFlag == 0 {
+		t.Error("retransmission does not have the T flag set")
+	}
+	if retransmitted.Header.EndToEndID != lost.Header.EndToEndID {
+		t.Errorf("End-to-End ID changed from %d to %d", lost.Header.EndToEndID, retransmitted.Header.EndToEndID)
+	}
+
+	for _, code := range []uint32{avp.SessionID, avp.CCRequestNumber} {
+		before, err := lost.FindAVP(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := retransmitted.FindAVP(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before.Data != after.Data {
+			t.Errorf("AVP %d changed from %v to %v", code, before.Data, after.Data)
+		}
+	}
+	destinationHost, err := retransmitted.FindAVP(avp.DestinationHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destinationHost.Data != datatype.DiameterIdentity("secondary") {
+		t.Errorf("retransmission addressed to %v", destinationHost.Data)
+	}
+}
+
+func TestPoolFailsBackToPrimary(t *testing.T) {
+	primary := NewTestServer()
+	defer primary.Close()
+	primaryCount := primary.CountCCR()
+	secondary := NewTestServer()
+	defer secondary.Close()
+	secondaryCount := secondary.CountCCR()
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: primary.Address, DestinationHost: "srv"},
+		PeerConfig{URL: secondary.Address, DestinationHost: "srv", Priority: 1},
+	)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	do := func() {
+		if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do()
+	if atomic.LoadInt32(primaryCount) != 1 || atomic.LoadInt32(secondaryCount) != 0 {
+		t.Fatal("request did not go to the primary")
+	}
+
+	primary.Conn().Close()
+	waitForState(t, pool.peers[0].client, WatchdogDown)
+	do()
+	if atomic.LoadInt32(secondaryCount) != 1 {
+		t.Fatal("request did not fail over to the secondary")
+	}
+
+	waitForState(t, pool.peers[0].client, WatchdogOkay)
+	do()
+	if atomic.LoadInt32(primaryCount) != 2 || atomic.LoadInt32(secondaryCount) != 1 {
+		t.Error("request did not fail back to the primary")
+	}
+}
+
+type ccRequest struct {
+	mockRequest
+	sessionID   datatype.UTF8String
+	requestType datatype.Enumerated
+}
+
+func (r *ccRequest) SessionID() datatype.UTF8String {
+	return r.sessionID
+}
+
+func (r *ccRequest) AVP() []*diam.AVP {
+	return []*diam.AVP{diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, r.requestType)}
+}
+
+func TestPoolPinsSessions(t *testing.T) {
+	var servers []*Server
+	var peers []PeerConfig
+	for i := 0; i < 2; i++ {
+		server := NewTestServer()
+		defer server.Close()
+		servers = append(servers, server)
+		peers = append(peers, PeerConfig{URL: server.Address, DestinationHost: "srv"})
+	}
+	pool := NewTestPool(RoundRobin, peers...)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	send := func(sessionID datatype.UTF8String, requestType datatype.Enumerated) *poolPeer {
+		t.Helper()
+		request := &ccRequest{mockRequest{outCh: make(chan *diam.Message, 1)}, sessionID, requestType}
+		if _, err := pool.Do(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		if pin, ok := pool.sessions[sessionID]; ok {
+			return pin.peer
+		}
+		return nil
+	}
+
+	first := send("client;1;1", 1)
+	second := send("client;1;2", 1)
+	if first == nil || second == nil || first == second {
+		t.Fatalf("sessions pinned to %v and %v", first, second)
+	}
+	for i := 0; i < 3; i++ {
+		if peer := send("client;1;1", 2); peer != first {
+			t.Fatalf("update %d moved the session", i)
+		}
+	}
+	if peer := send("client;1;1", 3); peer != nil {
+		t.Error("terminated session still pinned")
+	}
+
+	// The session moves when its peer is lost.
+	lost := servers[0]
+	if second.client.config.URL == servers[1].Address {
+		lost = servers[1]
+	}
+	lost.Close()
+	lost.Conn().Close()
+	waitForState(t, second.client, WatchdogDown)
+	if peer := send("client;1;2", 2); peer == nil || peer == second {
+		t.Errorf("session stayed on the lost peer")
+	}
+}
+
+// silentPrimary returns a pool whose primary peer stops answering CCRs, and
+// DWRs too if silenceDWR is set, without closing its connection, and whose
+// standby answers every request. The CCRs of the standby are returned on the
+// channel.
+func silentPrimary(t *testing.T, silenceDWR bool, txTimeout time.Duration) (*Pool, <-chan *diam.Message) {
+	primary := NewTestServer()
+	t.Cleanup(primary.Close)
+	silent := diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {})
+	answering := int32(1)
+	primary.mux.Handle("CCR", silent)
+	if silenceDWR {
+		handleDWR := primary.HandleDWR()
+		primary.mux.Handle("DWR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+			if atomic.LoadInt32(&answering) == 1 {
+				handleDWR(conn, m)
+			}
+		}))
+	}
+
+	standby := NewTestServer()
+	t.Cleanup(standby.Close)
+	standbyCh := standby.CaptureRequests("CCR")
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: primary.Address, DestinationHost: "primary"},
+		PeerConfig{URL: standby.Address, DestinationHost: "standby", Priority: 1},
+	)
+	for _, peer := range pool.peers {
+		peer.client.config.TxTimeout = txTimeout
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	waitForPoolState(t, pool, WatchdogOkay)
+	atomic.StoreInt32(&answering, 0)
+	return pool, standbyCh
+}
+
+func TestPoolFailsOverWhenPeerTurnsSuspect(t *testing.T) {
+	pool, standbyCh := silentPrimary(t, true, 10*time.Second)
+
+	start := time.Now()
+	if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("failover took %v", elapsed)
+	}
+	if m := <-standbyCh; m.Header.CommandFlags&diam.RetransmittedFlag == 0 {
+		t.Error("retransmission does not have the T flag set")
+	}
+}
+
+func TestPoolFailsOverWhenTxTimerExpires(t *testing.T) {
+	pool, standbyCh := silentPrimary(t, false, 200*time.Millisecond)
+
+	if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-standbyCh; m.Header.CommandFlags&diam.RetransmittedFlag == 0 {
+		t.Error("retransmission does not have the T flag set")
+	}
+	if state := pool.peers[0].client.WatchdogState(); state != WatchdogOkay {
+		t.Errorf("primary is %s", state)
+	}
+}
+
+// failingWriteConn is a connection whose writes fail while its reads still
+// work, as when the peer stops reading.
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (c failingWriteConn) Write(b []byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestPoolFailsOverWhenWriteFails(t *testing.T) {
+	primary := NewTestServer()
+	defer primary.Close()
+	standby := NewTestServer()
+	defer standby.Close()
+	standbyCh := standby.CaptureRequests("CCR")
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: primary.Address, DestinationHost: "primary"},
+		PeerConfig{URL: standby.Address, DestinationHost: "standby", Priority: 1},
+	)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	conn := pool.peers[0].client.connection().(*peerConn)
+	conn.writeMu.Lock()
+	conn.rwc = failingWriteConn{conn.rwc}
+	conn.writeMu.Unlock()
+
+	if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-standbyCh:
+	default:
+		t.Error("the request did not fail over to the standby")
+	}
+}
@@ -0,0 +1,296 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var ErrNoPeers = errors.New("dcc: no peers configured")
+
+type peerKey struct {
+	url             string
+	destinationHost string
+}
+
+// Reload replaces the peers and the policy of the pool. Peers are told apart
+// by URL and DestinationHost: those that are kept keep their connection,
+// new ones are connected before they take traffic, as by Start, and removed
+// ones stop taking traffic at once and are shut down with a DPR once their
+// outstanding requests are answered or ctx expires. The settings shared by
+// the peers are left as they are.
+func (p *Pool) Reload(ctx context.Context, peers []PeerConfig, policy BalancePolicy) error {
+	if len(peers) == 0 {
+		return ErrNoPeers
+	}
+	swap := p.prepareSwap(peers, policy)
+
+	// Holding acceptMu keeps Close from missing the new peers.
+	p.acceptMu.RLock()
+	if p.closing {
+		p.acceptMu.RUnlock()
+		swap.abort()
+		return ErrClientClosed
+	}
+	swap.commit()
+	p.acceptMu.RUnlock()
+	return shutdownPeers(ctx, swap.removed)
+}
+
+// peerSwap is a reload of the peers of a pool that is ready to be put in
+// place: the new peers are connected but take no traffic yet. It holds the
+// reloadMu of the pool until it is committed or aborted.
+type peerSwap struct {
+	pool    *Pool
+	policy  BalancePolicy
+	kept    map[*poolPeer]PeerConfig
+	peers   []*poolPeer
+	added   []*poolPeer
+	removed []*poolPeer
+}
+
+// prepareSwap connects the peers of configs the pool does not have yet.
+func (p *Pool) prepareSwap(configs []PeerConfig, policy BalancePolicy) *peerSwap {
+	p.reloadMu.Lock()
+
+	current := make(map[peerKey]*poolPeer)
+	for _, peer := range p.peerList() {
+		current[peerKey{peer.client.config.URL, string(peer.destinationHost)}] = peer
+	}
+	s := &peerSwap{pool: p, policy: policy, kept: make(map[*poolPeer]PeerConfig)}
+	for _, c := range configs {
+		key := peerKey{c.URL, string(c.DestinationHost)}
+		peer, ok := current[key]
+		if !ok {
+			peer = p.newPeer(c)
+			s.added = append(s.added, peer)
+		} else {
+			delete(current, key)
+			s.kept[peer] = c
+		}
+		s.peers = append(s.peers, peer)
+	}
+	for _, peer := range current {
+		s.removed = append(s.removed, peer)
+	}
+
+	for _, peer := range s.added {
+		if err := peer.connect(); err != nil {
+			peer.client.keepConnecting()
+		}
+	}
+	return s
+}
+
+// commit puts the new peers and policy in place and takes the removed peers
+// out of the pool. The caller holds the acceptMu of the pool, or of the
+// Router that owns it, and has checked that it is not closing.
+func (s *peerSwap) commit() {
+	p := s.pool
+	p.mu.Lock()
+	p.policy = s.policy
+	for peer, c := range s.kept {
+		peer.weight = c.Weight
+		if peer.weight <= 0 {
+			peer.weight = 1
+		}
+		peer.priority = c.Priority
+	}
+	p.mu.Unlock()
+
+	p.peersMu.Lock()
+	p.peers = s.peers
+	for _, peer := range s.added {
+		for _, ch := range p.subscribers {
+			peer.client.subscribe(ch)
+		}
+	}
+	p.peersMu.Unlock()
+
+	for _, peer := range s.removed {
+		atomic.StoreInt32(&peer.removed, 1)
+	}
+	p.reloadMu.Unlock()
+}
+
+// abort closes the new peers and leaves the pool as it was.
+func (s *peerSwap) abort() {
+	for _, peer := range s.added {
+		peer.close()
+	}
+	s.pool.reloadMu.Unlock()
+}
+
+// Reload replaces the routing table. The pool of a route whose Realm and
+// ApplicationID were already routed is kept and reloaded as by Pool.Reload;
+// the pools of new routes are started before the table is swapped, and the
+// pools of removed routes are shut down once their outstanding requests are
+// answered or ctx expires. Requests are always routed by either the old or
+// the new table. Every route is checked before anything changes: a reload
+// with a route without peers, or with two routes for the same Realm and
+// ApplicationID, and a reload that finds the Router closing leave the old
+// table and its pools as they were. The pools of new routes whose peers
+// cannot be reached yet keep trying to connect, as after Start, and do not
+// fail the reload. The settings shared by the routes are left as they are.
+func (r *Router) Reload(ctx context.Context, routes []Route) error {
+	if len(routes) == 0 {
+		return ErrNoPeers
+	}
+	keys := make(map[routeKey]bool)
+	for _, entry := range routes {
+		if len(entry.Peers) == 0 {
+			return ErrNoPeers
+		}
+		key := routeKey{entry.Realm, entry.ApplicationID}
+		if keys[key] {
+			return ErrDuplicateRoute
+		}
+		keys[key] = true
+	}
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	current, _ := r.table()
+	table := make(map[routeKey]*route)
+	var pools, added []*Pool
+	var swaps []*peerSwap
+	kept := make(map[*Pool]bool)
+	for _, entry := range routes {
+		key := routeKey{entry.Realm, entry.ApplicationID}
+		var pool *Pool
+		if old, ok := current[key]; ok {
+			pool = old.pool
+			swaps = append(swaps, pool.prepareSwap(routePeers(entry), entry.Policy))
+			kept[pool] = true
+		} else {
+			pool = r.newPool(entry)
+			pool.Start()
+			added = append(added, pool)
+		}
+		table[key] = &route{action: entry.Action, pool: pool}
+		pools = append(pools, pool)
+	}
+
+	// The pools of the Router are only closed once it is closing, which
+	// acceptMu holds off until the new table is in place.
+	r.acceptMu.RLock()
+	if r.closing {
+		r.acceptMu.RUnlock()
+		for _, swap := range swaps {
+			swap.abort()
+		}
+		for _, pool := range added {
+			pool.Close()
+		}
+		return ErrClientClosed
+	}
+	var removedPeers []*poolPeer
+	for _, swap := range swaps {
+		swap.commit()
+		removedPeers = append(removedPeers, swap.removed...)
+	}
+	r.routesMu.Lock()
+	r.routes, r.pools = table, pools
+	r.routesMu.Unlock()
+	r.acceptMu.RUnlock()
+
+	var removedPools []*Pool
+	for _, rt := range current {
+		if !kept[rt.pool] {
+			atomic.StoreInt32(&rt.removed, 1)
+			removedPools = append(removedPools, rt.pool)
+		}
+	}
+
+	errCh := make(chan error, len(removedPools)+1)
+	for _, pool := range removedPools {
+		go func(p *Pool) {
+			errCh <- p.Shutdown(ctx)
+		}(pool)
+	}
+	go func() {
+		errCh <- shutdownPeers(ctx, removedPeers)
+	}()
+	var err error
+	for i := 0; i < len(removedPools)+1; i++ {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// configSettleDelay lets an editor finish writing the configuration file
+// before it is loaded.
+const configSettleDelay = 100 * time.Millisecond
+
+// WatchConfig calls reload with the configuration LoadConfig reads from path
+// whenever the process receives SIGHUP or the file is written, until ctx is
+// done. The errors of LoadConfig and reload go to handler, if set, and the
+// running configuration is then kept. A Router is reloaded with
+//
+//	dcc.WatchConfig(ctx, path, func(c *dcc.Config) error {
+//		return router.Reload(ctx, c.RoutingConfig().Routes)
+//	}, handler)
+func WatchConfig(ctx context.Context, path string, reload func(*Config) error, handler ErrorHandler) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Editors often replace the file instead of writing it, which a watch on
+	// the file itself would not survive.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	apply := func() {
+		config, err := LoadConfig(path)
+		if err == nil {
+			err = reload(config)
+		}
+		if err != nil && handler != nil {
+			handler(err)
+		}
+	}
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(signals)
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				apply()
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) == filepath.Clean(path) && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					settle = time.After(configSettleDelay)
+				}
+			case <-settle:
+				settle = nil
+				apply()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				if handler != nil {
+					handler(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
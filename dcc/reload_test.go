@@ -0,0 +1,265 @@
+package dcc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+)
+
+func TestPoolReload(t *testing.T) {
+	old := NewTestServer()
+	defer old.Close()
+	handleCCR := old.HandleCCR()
+	old.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		time.Sleep(100 * time.Millisecond)
+		handleCCR(conn, m)
+	}))
+	kept := NewTestServer()
+	defer kept.Close()
+	keptCount := kept.CountCCR()
+	added := NewTestServer()
+	defer added.Close()
+	addedCount := added.CountCCR()
+
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: old.Address, DestinationHost: "srv"},
+		PeerConfig{URL: kept.Address, DestinationHost: "srv"},
+	)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+	oldClient, keptClient := pool.peerList()[0].client, pool.peerList()[1].client
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)})
+		done <- err
+	}()
+	for oldClient.pending.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := pool.Reload(ctx, []PeerConfig{
+		{URL: kept.Address, DestinationHost: "srv"},
+		{URL: added.Address, DestinationHost: "srv", Weight: 3},
+	}, Weighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("outstanding request failed: %v", err)
+	}
+	select {
+	case <-old.DisconnectNotify():
+	default:
+		t.Error("removed peer did not receive a DPR")
+	}
+
+	peers := pool.peerList()
+	if len(peers) != 2 || peers[0].client != keptClient {
+		t.Fatalf("peers after reload: %+v", peers)
+	}
+	waitForPoolState(t, pool, WatchdogOkay)
+	for i := 0; i < 4; i++ {
+		if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if k, a := atomic.LoadInt32(keptCount), atomic.LoadInt32(addedCount); k != 1 || a != 3 {
+		t.Errorf("kept peer received %d CCRs and added peer %d, want 1 and 3", k, a)
+	}
+
+	if err := pool.Reload(ctx, nil, RoundRobin); err != ErrNoPeers {
+		t.Errorf("expected ErrNoPeers, got %v", err)
+	}
+}
+
+func TestRouterReload(t *testing.T) {
+	prepaid := NewTestServer()
+	defer prepaid.Close()
+	prepaidCh := prepaid.CaptureRequests("CCR")
+	postpaid := NewTestServer()
+	defer postpaid.Close()
+	hybrid := NewTestServer()
+	defer hybrid.Close()
+	hybridCh := hybrid.CaptureRequests("CCR")
+
+	router := NewTestRouter(
+		Route{Realm: "www.huawei.com", Peers: []PeerConfig{{URL: prepaid.Address, DestinationHost: "cbp"}}},
+		Route{Realm: "billing.dtac.co.th", Peers: []PeerConfig{{URL: postpaid.Address, DestinationHost: "bill"}}},
+	)
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	waitForRouterState(t, router, WatchdogOkay)
+	prepaidPool := router.lookup(&mockRequest{}).pool
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := router.Reload(ctx, []Route{
+		{Realm: "www.huawei.com", Peers: []PeerConfig{{URL: prepaid.Address, DestinationHost: "cbp"}}},
+		{Realm: "hybrid.dtac.co.th", Peers: []PeerConfig{{URL: hybrid.Address, DestinationHost: "hyb"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-postpaid.DisconnectNotify():
+	default:
+		t.Error("the peer of the removed route did not receive a DPR")
+	}
+	if rt := router.lookup(&mockRequest{}); rt == nil || rt.pool != prepaidPool {
+		t.Error("the pool of an unchanged route was replaced")
+	}
+	waitForRouterState(t, router, WatchdogOkay)
+
+	if _, err := router.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	request := &realmRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, realm: "hybrid.dtac.co.th"}
+	if _, err := router.Do(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	removed := &realmRequest{realm: "billing.dtac.co.th"}
+	if _, err := router.Do(context.Background(), removed); err != ErrNoRoute {
+		t.Errorf("expected ErrNoRoute, got %v", err)
+	}
+	for name, ch := range map[string]<-chan *diam.Message{"prepaid": prepaidCh, "hybrid": hybridCh} {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("no request for %s", name)
+		}
+	}
+}
+
+func TestRouterReloadFailsWithoutChanges(t *testing.T) {
+	prepaid := NewTestServer()
+	defer prepaid.Close()
+	hybrid := NewTestServer()
+	defer hybrid.Close()
+
+	router := NewTestRouter(
+		Route{Realm: "www.huawei.com", Peers: []PeerConfig{{URL: prepaid.Address, DestinationHost: "cbp"}}},
+	)
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	waitForRouterState(t, router, WatchdogOkay)
+	table, pools := router.table()
+
+	checkUnchanged := func(peers int) {
+		t.Helper()
+		if current, _ := router.table(); !reflect.DeepEqual(current, table) {
+			t.Error("the routing table was changed")
+		}
+		if n := len(pools[0].peerList()); n != 1 {
+			t.Errorf("the pool of the route has %d peers", n)
+		}
+		router.clients.mu.Lock()
+		n := len(router.clients.clients)
+		router.clients.mu.Unlock()
+		if n != peers {
+			t.Errorf("%d peer clients, want %d", n, peers)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	routes := []Route{
+		{Realm: "www.huawei.com", Peers: []PeerConfig{
+			{URL: prepaid.Address, DestinationHost: "cbp"},
+			{URL: hybrid.Address, DestinationHost: "hyb"},
+		}},
+		{Realm: "hybrid.dtac.co.th", Peers: []PeerConfig{{URL: hybrid.Address, DestinationHost: "hyb"}}},
+	}
+	if err := router.Reload(ctx, append(routes, Route{Realm: "billing.dtac.co.th"})); err != ErrNoPeers {
+		t.Errorf("expected ErrNoPeers, got %v", err)
+	}
+	checkUnchanged(1)
+	if err := router.Reload(ctx, append(routes, routes[1])); err != ErrDuplicateRoute {
+		t.Errorf("expected ErrDuplicateRoute, got %v", err)
+	}
+	checkUnchanged(1)
+
+	router.Close()
+	if err := router.Reload(ctx, routes); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	checkUnchanged(0)
+}
+
+func TestWatchConfig(t *testing.T) {
+	const config = `
+origin_host: client
+origin_realm: localhost
+destination_realm: localhost
+product_name: omr
+peers:
+  - url: %s
+`
+	path := writeConfig(t, "dcc.yaml", fmt.Sprintf(config, "10.0.0.1:3868"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configCh := make(chan *Config, 1)
+	errCh := make(chan error, 1)
+	err := WatchConfig(ctx, path, func(c *Config) error {
+		configCh <- c
+		return nil
+	}, func(err error) {
+		errCh <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(trigger, url string) {
+		t.Helper()
+		select {
+		case c := <-configCh:
+			if peers := c.PoolConfig().Peers; len(peers) != 1 || peers[0].URL != url {
+				t.Errorf("%s loaded peers %+v, want %s", trigger, peers, url)
+			}
+		case err := <-errCh:
+			t.Fatalf("%s: %v", trigger, err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s did not reload the configuration", trigger)
+		}
+	}
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(fmt.Sprintf(config, "10.0.0.2:3868"))
+	expect("writing the file", "10.0.0.2:3868")
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	expect("SIGHUP", "10.0.0.2:3868")
+
+	write("origin_hots: client\n")
+	select {
+	case c := <-configCh:
+		t.Errorf("invalid configuration applied: %+v", c)
+	case <-errCh:
+	case <-time.After(2 * time.Second):
+		t.Error("invalid configuration not reported")
+	}
+}
@@ -0,0 +1,342 @@
+package dcc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// Result is the outcome of a request as its answer reports it, in a
+// Result-Code AVP or, with the VendorID of the vendor that defines the code,
+// in an Experimental-Result AVP.
+type Result struct {
+	Code         uint32
+	VendorID     uint32
+	Experimental bool
+}
+
+// ResultOf returns the Result of an answer, and false when the answer has
+// neither a Result-Code nor an Experimental-Result-Code. Only the base
+// protocol AVPs count: AVPs of a vendor that reuse their codes, at the top
+// level or inside the Experimental-Result, are ignored.
+func ResultOf(m *diam.Message) (Result, bool) {
+	var experimental *diam.GroupedAVP
+	for _, a := range m.AVP {
+		if a.VendorID != 0 {
+			continue
+		}
+		switch a.Code {
+		case avp.ResultCode:
+			if code, ok := a.Data.(datatype.Unsigned32); ok {
+				return Result{Code: uint32(code)}, true
+			}
+		case avp.ExperimentalResult:
+			if group, ok := a.Data.(*diam.GroupedAVP); ok && experimental == nil {
+				experimental = group
+			}
+		}
+	}
+	if experimental == nil {
+		return Result{}, false
+	}
+	r := Result{Experimental: true}
+	found := false
+	for _, a := range experimental.AVP {
+		if a.VendorID != 0 {
+			continue
+		}
+		switch a.Code {
+		case avp.VendorID:
+			if id, ok := a.Data.(datatype.Unsigned32); ok {
+				r.VendorID = uint32(id)
+			}
+		case avp.ExperimentalResultCode:
+			if code, ok := a.Data.(datatype.Unsigned32); ok {
+				r.Code = uint32(code)
+				found = true
+			}
+		}
+	}
+	return r, found
+}
+
+// resultCode returns the Result-Code of an answer, or the
+// Experimental-Result-Code when it carries an Experimental-Result instead.
+// It is 0 when the answer has neither.
+func resultCode(m *diam.Message) uint32 {
+	r, _ := ResultOf(m)
+	return r.Code
+}
+
+type ResultClass int
+
+const (
+	ResultUnknown ResultClass = iota
+	// ResultInformational covers 1xxx codes, such as
+	// DIAMETER_MULTI_ROUND_AUTH.
+	ResultInformational
+	// ResultSuccess covers 2xxx codes.
+	ResultSuccess
+	// ResultProtocolError covers 3xxx codes, which are sent with the E bit
+	// and usually by an agent rather than the server.
+	ResultProtocolError
+	// ResultTransientFailure covers 4xxx codes: the request may succeed
+	// later.
+	ResultTransientFailure
+	// ResultPermanentFailure covers 5xxx codes: the request should not be
+	// sent again as it is.
+	ResultPermanentFailure
+)
+
+func (c ResultClass) String() string {
+	switch c {
+	case ResultInformational:
+		return "informational"
+	case ResultSuccess:
+		return "success"
+	case ResultProtocolError:
+		return "protocol error"
+	case ResultTransientFailure:
+		return "transient failure"
+	case ResultPermanentFailure:
+		return "permanent failure"
+	}
+	return "unknown"
+}
+
+// ResultAction is what a client can do about a failed request.
+type ResultAction int
+
+const (
+	// ActionNone is the action of successful and informational results.
+	ActionNone ResultAction = iota
+	// ActionRetry means the same request may succeed if it is sent again
+	// later.
+	ActionRetry
+	// ActionDifferentPeer means the request may succeed if it is sent to
+	// another peer.
+	ActionDifferentPeer
+	// ActionPermanent means the request will keep failing.
+	ActionPermanent
+)
+
+func (a ResultAction) String() string {
+	switch a {
+	case ActionNone:
+		return "none"
+	case ActionRetry:
+		return "retry"
+	case ActionDifferentPeer:
+		return "different peer"
+	case ActionPermanent:
+		return "permanent"
+	}
+	return "unknown"
+}
+
+func (r Result) Class() ResultClass {
+	if r.Code < 1000 || r.Code >= 6000 {
+		return ResultUnknown
+	}
+	return ResultClass(r.Code / 1000)
+}
+
+// Success reports whether the request succeeded, fully or partly.
+func (r Result) Success() bool {
+	return r.Class() == ResultSuccess
+}
+
+// Action classifies the failure of a request. Codes defined by a vendor are
+// classified by their range only.
+func (r Result) Action() ResultAction {
+	if r.ietf() {
+		switch r.Code {
+		case diam.UnableToDeliver, diam.TooBusy, diam.RedirectIndication:
+			return ActionDifferentPeer
+		case CreditControlNotApplicable:
+			return ActionPermanent
+		}
+	}
+	switch r.Class() {
+	case ResultInformational, ResultSuccess:
+		return ActionNone
+	case ResultTransientFailure:
+		return ActionRetry
+	}
+	return ActionPermanent
+}
+
+// Name returns the name the RFCs give to the code, such as
+// "DIAMETER_USER_UNKNOWN", or an empty string for vendor and unknown codes.
+func (r Result) Name() string {
+	if !r.ietf() {
+		return ""
+	}
+	return resultNames[r.Code]
+}
+
+func (r Result) String() string {
+	s := fmt.Sprintf("Result-Code %d", r.Code)
+	if r.Experimental {
+		s = fmt.Sprintf("Experimental-Result-Code %d of vendor %d", r.Code, r.VendorID)
+	}
+	if name := r.Name(); name != "" {
+		s += " (" + name + ")"
+	}
+	return s
+}
+
+// Err returns nil for successful and informational results and a
+// *ResultError otherwise.
+func (r Result) Err() error {
+	if r.Action() == ActionNone {
+		return nil
+	}
+	return &ResultError{Result: r}
+}
+
+// ietf reports whether the code is one of the RFCs rather than of a vendor.
+func (r Result) ietf() bool {
+	return !r.Experimental || r.VendorID == 0
+}
+
+// is matches r with the sentinel of its code and the one of its class.
+func (r Result) is(target error) bool {
+	if r.ietf() && target == resultErrors[r.Code] && target != nil {
+		return true
+	}
+	switch r.Class() {
+	case ResultProtocolError:
+		return target == ErrProtocolError
+	case ResultTransientFailure:
+		return target == ErrTransientFailure
+	case ResultPermanentFailure:
+		return target == ErrPermanentFailure
+	}
+	return false
+}
+
+// ResultError is a failed Result. It matches, with errors.Is, the sentinel
+// error of its code, such as ErrUserUnknown, and the one of its class, such
+// as ErrPermanentFailure.
+type ResultError struct {
+	Result Result
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("dcc: request failed with %s", e.Result)
+}
+
+func (e *ResultError) Is(target error) bool {
+	return e.Result.is(target)
+}
+
+// Result-Codes of the credit-control application, RFC 4006 section 9.
+const (
+	EndUserServiceDenied       = 4010
+	CreditControlNotApplicable = 4011
+	CreditLimitReached         = 4012
+	UserUnknown                = 5030
+	RatingFailed               = 5031
+)
+
+var resultNames = map[uint32]string{
+	diam.MultiRoundAuth:         "DIAMETER_MULTI_ROUND_AUTH",
+	diam.Success:                "DIAMETER_SUCCESS",
+	diam.LimitedSuccess:         "DIAMETER_LIMITED_SUCCESS",
+	diam.CommandUnsupported:     "DIAMETER_COMMAND_UNSUPPORTED",
+	diam.UnableToDeliver:        "DIAMETER_UNABLE_TO_DELIVER",
+	diam.RealmNotServed:         "DIAMETER_REALM_NOT_SERVED",
+	diam.TooBusy:                "DIAMETER_TOO_BUSY",
+	diam.LoopDetected:           "DIAMETER_LOOP_DETECTED",
+	diam.RedirectIndication:     "DIAMETER_REDIRECT_INDICATION",
+	diam.ApplicationUnsupported: "DIAMETER_APPLICATION_UNSUPPORTED",
+	diam.InvalidHDRBits:         "DIAMETER_INVALID_HDR_BITS",
+	diam.InvalidAVPBits:         "DIAMETER_INVALID_AVP_BITS",
+	diam.UnknownPeer:            "DIAMETER_UNKNOWN_PEER",
+	diam.AuthenticationRejected: "DIAMETER_AUTHENTICATION_REJECTED",
+	diam.OutOfSpace:             "DIAMETER_OUT_OF_SPACE",
+	diam.ElectionLost:           "ELECTION_LOST",
+	EndUserServiceDenied:        "DIAMETER_END_USER_SERVICE_DENIED",
+	CreditControlNotApplicable:  "DIAMETER_CREDIT_CONTROL_NOT_APPLICABLE",
+	CreditLimitReached:          "DIAMETER_CREDIT_LIMIT_REACHED",
+	diam.AVPUnsupported:         "DIAMETER_AVP_UNSUPPORTED",
+	diam.UnknownSessionID:       "DIAMETER_UNKNOWN_SESSION_ID",
+	diam.AuthorizationRejected:  "DIAMETER_AUTHORIZATION_REJECTED",
+	diam.InvalidAVPValue:        "DIAMETER_INVALID_AVP_VALUE",
+	diam.MissingAVP:             "DIAMETER_MISSING_AVP",
+	diam.ResourcesExceeded:      "DIAMETER_RESOURCES_EXCEEDED",
+	diam.ContradictingAVPs:      "DIAMETER_CONTRADICTING_AVPS",
+	diam.AVPNotAllowed:          "DIAMETER_AVP_NOT_ALLOWED",
+	diam.AVPOccursTooManyTimes:  "DIAMETER_AVP_OCCURS_TOO_MANY_TIMES",
+	diam.NoCommonApplication:    "DIAMETER_NO_COMMON_APPLICATION",
+	diam.UnsupportedVersion:     "DIAMETER_UNSUPPORTED_VERSION",
+	diam.UnableToComply:         "DIAMETER_UNABLE_TO_COMPLY",
+	diam.InvalidBitInHeader:     "DIAMETER_INVALID_BIT_IN_HEADER",
+	diam.InvalidAVPLenght:       "DIAMETER_INVALID_AVP_LENGTH",
+	diam.InvalidMessageLength:   "DIAMETER_INVALID_MESSAGE_LENGTH",
+	diam.InvalidAVPBitCombo:     "DIAMETER_INVALID_AVP_BIT_COMBO",
+	diam.NoCommonSecurity:       "DIAMETER_NO_COMMON_SECURITY",
+	UserUnknown:                 "DIAMETER_USER_UNKNOWN",
+	RatingFailed:                "DIAMETER_RATING_FAILED",
+}
+
+var resultErrors = make(map[uint32]error)
+
+// resultSentinel returns the sentinel error of a failed Result-Code.
+func resultSentinel(code uint32) error {
+	err := errors.New("dcc: " + resultNames[code])
+	resultErrors[code] = err
+	return err
+}
+
+// The sentinel errors of the classes of failures.
+var (
+	ErrProtocolError    = errors.New("dcc: protocol error")
+	ErrTransientFailure = errors.New("dcc: transient failure")
+	ErrPermanentFailure = errors.New("dcc: permanent failure")
+)
+
+// The sentinel errors of the failed Result-Codes of RFC 6733 and RFC 4006.
+var (
+	ErrCommandUnsupported     = resultSentinel(diam.CommandUnsupported)
+	ErrUnableToDeliver        = resultSentinel(diam.UnableToDeliver)
+	ErrRealmNotServed         = resultSentinel(diam.RealmNotServed)
+	ErrTooBusy                = resultSentinel(diam.TooBusy)
+	ErrLoopDetected           = resultSentinel(diam.LoopDetected)
+	ErrRedirectIndication     = resultSentinel(diam.RedirectIndication)
+	ErrApplicationUnsupported = resultSentinel(diam.ApplicationUnsupported)
+	ErrInvalidHDRBits         = resultSentinel(diam.InvalidHDRBits)
+	ErrInvalidAVPBits         = resultSentinel(diam.InvalidAVPBits)
+	ErrUnknownPeer            = resultSentinel(diam.UnknownPeer)
+
+	ErrAuthenticationRejected     = resultSentinel(diam.AuthenticationRejected)
+	ErrOutOfSpace                 = resultSentinel(diam.OutOfSpace)
+	ErrElectionLost               = resultSentinel(diam.ElectionLost)
+	ErrEndUserServiceDenied       = resultSentinel(EndUserServiceDenied)
+	ErrCreditControlNotApplicable = resultSentinel(CreditControlNotApplicable)
+	ErrCreditLimitReached         = resultSentinel(CreditLimitReached)
+
+	ErrAVPUnsupported        = resultSentinel(diam.AVPUnsupported)
+	ErrUnknownSessionID      = resultSentinel(diam.UnknownSessionID)
+	ErrAuthorizationRejected = resultSentinel(diam.AuthorizationRejected)
+	ErrInvalidAVPValue       = resultSentinel(diam.InvalidAVPValue)
+	ErrMissingAVP            = resultSentinel(diam.MissingAVP)
+	ErrResourcesExceeded     = resultSentinel(diam.ResourcesExceeded)
+	ErrContradictingAVPs     = resultSentinel(diam.ContradictingAVPs)
+	ErrAVPNotAllowed         = resultSentinel(diam.AVPNotAllowed)
+	ErrAVPOccursTooManyTimes = resultSentinel(diam.AVPOccursTooManyTimes)
+	ErrNoCommonApplication   = resultSentinel(diam.NoCommonApplication)
+	ErrUnsupportedVersion    = resultSentinel(diam.UnsupportedVersion)
+	ErrUnableToComply        = resultSentinel(diam.UnableToComply)
+	ErrInvalidBitInHeader    = resultSentinel(diam.InvalidBitInHeader)
+	ErrInvalidAVPLength      = resultSentinel(diam.InvalidAVPLenght)
+	ErrInvalidMessageLength  = resultSentinel(diam.InvalidMessageLength)
+	ErrInvalidAVPBitCombo    = resultSentinel(diam.InvalidAVPBitCombo)
+	ErrNoCommonSecurity      = resultSentinel(diam.NoCommonSecurity)
+	ErrUserUnknown           = resultSentinel(UserUnknown)
+	ErrRatingFailed          = resultSentinel(RatingFailed)
+)
@@ -0,0 +1,130 @@
+package dcc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+func TestResultOf(t *testing.T) {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default).Answer(CreditLimitReached)
+	if r, ok := ResultOf(m); !ok || r != (Result{Code: CreditLimitReached}) {
+		t.Errorf("Result-Code: %v %v", r, ok)
+	}
+
+	m = diam.NewMessage(diam.CreditControl, 0, 4, 1, 1, dict.Default)
+	m.NewAVP(avp.ExperimentalResult, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415)),
+		diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit, 0, datatype.Unsigned32(5030)),
+	}})
+	if r, ok := ResultOf(m); !ok || r != (Result{Code: 5030, VendorID: 10415, Experimental: true}) {
+		t.Errorf("Experimental-Result: %v %v", r, ok)
+	}
+
+	if r, ok := ResultOf(diam.NewMessage(diam.CreditControl, 0, 4, 1, 1, dict.Default)); ok {
+		t.Errorf("result %v in an answer without one", r)
+	}
+}
+
+func TestResultOfIgnoresVendorAVPs(t *testing.T) {
+	m := diam.NewMessage(diam.CreditControl, 0, 4, 1, 1, dict.Default)
+	m.NewAVP(avp.ResultCode, avp.Mbit|avp.Vbit, 10415, datatype.Unsigned32(9999))
+	m.NewAVP(avp.ExperimentalResult, avp.Mbit|avp.Vbit, 10415, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit, 0, datatype.Unsigned32(9998)),
+	}})
+	if r, ok := ResultOf(m); ok {
+		t.Errorf("result %v read from vendor AVPs", r)
+	}
+
+	m.NewAVP(avp.ExperimentalResult, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415)),
+		diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit|avp.Vbit, 10415, datatype.Unsigned32(9997)),
+		diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit, 0, datatype.Unsigned32(5030)),
+	}})
+	if r, ok := ResultOf(m); !ok || r != (Result{Code: 5030, VendorID: 10415, Experimental: true}) {
+		t.Errorf("Experimental-Result: %v %v", r, ok)
+	}
+
+	m.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(diam.Success))
+	if r, ok := ResultOf(m); !ok || r != (Result{Code: diam.Success}) {
+		t.Errorf("Result-Code: %v %v", r, ok)
+	}
+}
+
+func TestResultClassification(t *testing.T) {
+	for _, c := range []struct {
+		result Result
+		class  ResultClass
+		action ResultAction
+		is     []error
+		isNot  []error
+	}{
+		{Result{Code: diam.MultiRoundAuth}, ResultInformational, ActionNone, nil, nil},
+		{Result{Code: diam.Success}, ResultSuccess, ActionNone, nil, nil},
+		{Result{Code: diam.LimitedSuccess}, ResultSuccess, ActionNone, nil, nil},
+		{Result{Code: diam.UnableToDeliver}, ResultProtocolError, ActionDifferentPeer, []error{ErrUnableToDeliver, ErrProtocolError}, []error{ErrTooBusy}},
+		{Result{Code: diam.TooBusy}, ResultProtocolError, ActionDifferentPeer, []error{ErrTooBusy, ErrProtocolError}, nil},
+		{Result{Code: diam.LoopDetected}, ResultProtocolError, ActionPermanent, []error{ErrLoopDetected}, nil},
+		{Result{Code: EndUserServiceDenied}, ResultTransientFailure, ActionRetry, []error{ErrEndUserServiceDenied, ErrTransientFailure}, []error{ErrPermanentFailure}},
+		{Result{Code: CreditControlNotApplicable}, ResultTransientFailure, ActionPermanent, []error{ErrCreditControlNotApplicable}, nil},
+		{Result{Code: CreditLimitReached}, ResultTransientFailure, ActionRetry, []error{ErrCreditLimitReached, ErrTransientFailure}, nil},
+		{Result{Code: diam.MissingAVP}, ResultPermanentFailure, ActionPermanent, []error{ErrMissingAVP, ErrPermanentFailure}, []error{ErrUserUnknown}},
+		{Result{Code: UserUnknown}, ResultPermanentFailure, ActionPermanent, []error{ErrUserUnknown, ErrPermanentFailure}, nil},
+		{Result{Code: UserUnknown, Experimental: true}, ResultPermanentFailure, ActionPermanent, []error{ErrUserUnknown}, nil},
+		{Result{Code: 5030, VendorID: 10415, Experimental: true}, ResultPermanentFailure, ActionPermanent, []error{ErrPermanentFailure}, []error{ErrUserUnknown}},
+		{Result{Code: 3002, VendorID: 10415, Experimental: true}, ResultProtocolError, ActionPermanent, []error{ErrProtocolError}, []error{ErrUnableToDeliver}},
+		{Result{Code: 42}, ResultUnknown, ActionPermanent, nil, []error{ErrProtocolError, ErrTransientFailure, ErrPermanentFailure}},
+	} {
+		if class := c.result.Class(); class != c.class {
+			t.Errorf("%v: class %v, want %v", c.result, class, c.class)
+		}
+		if action := c.result.Action(); action != c.action {
+			t.Errorf("%v: action %v, want %v", c.result, action, c.action)
+		}
+		err := c.result.Err()
+		if (err == nil) != (c.action == ActionNone) {
+			t.Errorf("%v: error %v", c.result, err)
+		}
+		wrapped := fmt.Errorf("ccr: %w", err)
+		for _, target := range c.is {
+			if !errors.Is(wrapped, target) {
+				t.Errorf("%v is not %v", c.result, target)
+			}
+		}
+		for _, target := range c.isNot {
+			if errors.Is(wrapped, target) {
+				t.Errorf("%v is %v", c.result, target)
+			}
+		}
+	}
+}
+
+func TestResultString(t *testing.T) {
+	for _, c := range []struct {
+		result Result
+		want   string
+	}{
+		{Result{Code: UserUnknown}, "Result-Code 5030 (DIAMETER_USER_UNKNOWN)"},
+		{Result{Code: 4999}, "Result-Code 4999"},
+		{Result{Code: 5030, VendorID: 10415, Experimental: true}, "Experimental-Result-Code 5030 of vendor 10415"},
+	} {
+		if got := c.result.String(); got != c.want {
+			t.Errorf("%q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestFailureErrorsMatchResultSentinels(t *testing.T) {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default).Answer(UserUnknown)
+	if err := error(answerError(dict.Default, m)); !errors.Is(err, ErrUserUnknown) || !errors.Is(err, ErrPermanentFailure) {
+		t.Errorf("%v does not match its sentinels", err)
+	}
+	if err := error(&CapabilitiesError{ResultCode: diam.NoCommonApplication}); !errors.Is(err, ErrNoCommonApplication) {
+		t.Errorf("%v does not match ErrNoCommonApplication", err)
+	}
+}
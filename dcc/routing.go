@@ -0,0 +1,404 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RouteAction is the Local Action of a routing table entry, RFC 6733 section
+// 2.7, seen from the client that originates the request.
+type RouteAction int
+
+const (
+	// RouteLocal sends the request straight to the servers of the realm,
+	// addressed to the chosen peer with Destination-Host.
+	RouteLocal RouteAction = iota
+	// RouteRelay and RouteProxy send the request to an agent that routes it
+	// by Destination-Realm, so Destination-Host is left out.
+	RouteRelay
+	RouteProxy
+	// RouteRedirect sends the request to a redirect agent and resends it to
+	// the first Redirect-Host of a 3006 answer that is a peer of the router.
+	RouteRedirect
+)
+
+func (a RouteAction) String() string {
+	switch a {
+	case RouteLocal:
+		return "LOCAL"
+	case RouteRelay:
+		return "RELAY"
+	case RouteProxy:
+		return "PROXY"
+	case RouteRedirect:
+		return "REDIRECT"
+	}
+	return "UNKNOWN"
+}
+
+// Route is a static routing table entry. An empty Realm makes it the default
+// route and a zero ApplicationID matches any application of the realm.
+type Route struct {
+	Realm         datatype.DiameterIdentity
+	ApplicationID uint32
+	Action        RouteAction
+	Peers         []PeerConfig
+	Policy        BalancePolicy
+}
+
+// RoutingConfig configures a Router. The embedded DiameterConfig holds the
+// settings shared by every peer; its DestinationRealm is used for requests
+// that do not name one.
+type RoutingConfig struct {
+	DiameterConfig
+	Routes []Route
+}
+
+// RealmRequest is implemented by requests that name their Destination-Realm
+// instead of using the configured one.
+type RealmRequest interface {
+	Request
+	DestinationRealm() datatype.DiameterIdentity
+}
+
+func (d *diameterClient) destinationRealm(request Request) datatype.DiameterIdentity {
+	if r, ok := request.(RealmRequest); ok {
+		if realm := r.DestinationRealm(); realm != "" {
+			return realm
+		}
+	}
+	return d.config.DestinationRealm
+}
+
+var (
+	ErrNoRoute        = errors.New("dcc: no route to destination realm")
+	ErrDuplicateRoute = errors.New("dcc: more than one route for a realm and application")
+)
+
+type routeKey struct {
+	realm         datatype.DiameterIdentity
+	applicationID uint32
+}
+
+type route struct {
+	action RouteAction
+	pool   *Pool
+	// removed is set once Reload took the route out of the table.
+	removed int32
+}
+
+// Router selects the peer group of each request from its Destination-Realm
+// and Application-Id. Every route is served by its own Pool, but the routes
+// that list the same peer URL share its connection.
+type Router struct {
+	config DiameterConfig
+
+	// routes and pools are replaced, never modified, by Reload.
+	routesMu sync.RWMutex
+	routes   map[routeKey]*route
+	pools    []*Pool
+	reloadMu sync.Mutex
+
+	clients *peerSet
+
+	errorCh chan error
+
+	acceptMu sync.RWMutex
+	closing  bool
+	inflight sync.WaitGroup
+}
+
+func NewRouter(config RoutingConfig) *Router {
+	shared := config.DiameterConfig
+	if shared.SessionIDGenerator == nil {
+		shared.SessionIDGenerator = NewSessionIDGenerator(shared.OriginHost, uint32(time.Now().Unix()), "")
+	}
+
+	r := &Router{
+		config:  shared,
+		routes:  make(map[routeKey]*route),
+		clients: newPeerSet(shared),
+		errorCh: make(chan error, 10),
+	}
+	for _, entry := range config.Routes {
+		pool := r.newPool(entry)
+		r.routes[routeKey{entry.Realm, entry.ApplicationID}] = &route{action: entry.Action, pool: pool}
+		r.pools = append(r.pools, pool)
+	}
+	return r
+}
+
+func (r *Router) newPool(entry Route) *Pool {
+	c := r.config
+	if entry.Realm != "" {
+		c.DestinationRealm = entry.Realm
+	}
+	pool := newPool(PoolConfig{DiameterConfig: c, Peers: routePeers(entry), Policy: entry.Policy}, r.clients)
+	pool.errorCh = r.errorCh
+	return pool
+}
+
+// routePeers returns the peers of a route, without their DestinationHost
+// unless the route is LOCAL.
+func routePeers(entry Route) []PeerConfig {
+	peers := append([]PeerConfig(nil), entry.Peers...)
+	if entry.Action != RouteLocal {
+		for i := range peers {
+			peers[i].DestinationHost = ""
+		}
+	}
+	return peers
+}
+
+func (r *Router) table() (map[routeKey]*route, []*Pool) {
+	r.routesMu.RLock()
+	defer r.routesMu.RUnlock()
+	return r.routes, r.pools
+}
+
+// Start connects every route. Peers that cannot be reached keep retrying in
+// the background; the error of the first route none of whose peers could be
+// connected is returned.
+func (r *Router) Start() error {
+	var err error
+	_, pools := r.table()
+	for _, pool := range pools {
+		if e := pool.Start(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *Router) ErrorNotify() <-chan error {
+	return r.errorCh
+}
+
+// Subscribe returns a channel that receives the Events of every peer,
+// including those added later by Reload.
+func (r *Router) Subscribe() <-chan Event {
+	ch := make(chan Event, 10)
+	r.clients.subscribe(ch)
+	return ch
+}
+
+func (r *Router) Serve(request Request) error {
+	return r.ServeContext(context.Background(), request)
+}
+
+// ServeContext is Serve for a request made on behalf of ctx, as for a client.
+func (r *Router) ServeContext(ctx context.Context, request Request) error {
+	if r.lookup(request) == nil {
+		r.config.Metrics.requestFailed(r.config, request, ErrNoRoute)
+		return ErrNoRoute
+	}
+	if !r.accept() {
+		r.config.Metrics.requestFailed(r.config, request, ErrClientClosed)
+		return ErrClientClosed
+	}
+	ctx, end := startSpan(context.WithoutCancel(ctx), r.config, request)
+	go func() {
+		defer r.inflight.Done()
+		m, err := r.do(ctx, request)
+		end(m, err)
+		if err != nil {
+			r.config.Metrics.requestFailed(r.config, request, err)
+			fail(request, r.config.ErrorHandler, r.errorCh, err)
+			return
+		}
+		request.Response(m)
+	}()
+	return nil
+}
+
+func (r *Router) Do(ctx context.Context, request Request) (*diam.Message, error) {
+	if !r.accept() {
+		r.config.Metrics.requestFailed(r.config, request, ErrClientClosed)
+		return nil, ErrClientClosed
+	}
+	defer r.inflight.Done()
+	ctx, end := startSpan(ctx, r.config, request)
+	m, err := r.do(ctx, request)
+	end(m, err)
+	r.config.Metrics.requestFailed(r.config, request, err)
+	return m, err
+}
+
+func (r *Router) do(ctx context.Context, request Request) (*diam.Message, error) {
+	rt := r.lookup(request)
+	if rt == nil {
+		return nil, ErrNoRoute
+	}
+	t, m, err := rt.pool.route(ctx, request)
+	// The pool of a route that Reload removed refuses the requests that
+	// looked the route up just before the new table was in place.
+	if errors.Is(err, ErrClientClosed) && atomic.LoadInt32(&rt.removed) == 1 {
+		if rt = r.lookup(request); rt == nil {
+			return nil, ErrNoRoute
+		}
+		t, m, err = rt.pool.route(ctx, request)
+	}
+	if err != nil || rt.action != RouteRedirect {
+		return m, err
+	}
+	return r.redirect(ctx, t, m)
+}
+
+func (r *Router) accept() bool {
+	r.acceptMu.RLock()
+	defer r.acceptMu.RUnlock()
+	if r.closing {
+		return false
+	}
+	r.inflight.Add(1)
+	return true
+}
+
+// lookup finds the route of a request, trying the realm and application
+// first, then the realm alone, then the default route.
+func (r *Router) lookup(request Request) *route {
+	realm := r.config.DestinationRealm
+	if rr, ok := request.(RealmRequest); ok && rr.DestinationRealm() != "" {
+		realm = rr.DestinationRealm()
+	}
+	applicationID := requestCommand(request).ApplicationID
+
+	routes, _ := r.table()
+	for _, key := range []routeKey{
+		{realm, applicationID},
+		{realm, 0},
+		{"", applicationID},
+		{"", 0},
+	} {
+		if rt, ok := routes[key]; ok {
+			return rt
+		}
+	}
+	return nil
+}
+
+// redirect resends the request of t to the Redirect-Host of answer, through
+// the pool that has it, with the Session-Id and End-to-End identifier it was
+// sent with.
+func (r *Router) redirect(ctx context.Context, t *transaction, answer *diam.Message) (*diam.Message, error) {
+	resultCode, err := answer.FindAVP(avp.ResultCode)
+	if err != nil || resultCode.Data != datatype.Unsigned32(diam.RedirectIndication) {
+		return answer, nil
+	}
+	for _, a := range answer.AVP {
+		if a.Code != avp.RedirectHost {
+			continue
+		}
+		uri, ok := a.Data.(datatype.DiameterURI)
+		if !ok {
+			continue
+		}
+		if pool, peer := r.findPeer(diameterURIHost(uri)); peer != nil {
+			trace.SpanFromContext(ctx).AddEvent("redirect", trace.WithAttributes(
+				attribute.String("diameter.redirect_host", string(uri)),
+			))
+			// A redirect is no retransmission: the request keeps its
+			// End-to-End identifier but not the T flag.
+			next := newTransaction(ctx, t.request)
+			next.sessionID = t.sessionID
+			next.message = t.message
+			return pool.redirect(next, peer)
+		}
+	}
+	return answer, nil
+}
+
+// findPeer returns the peer whose Diameter identity is host and its pool,
+// preferring a peer whose watchdog is OKAY.
+func (r *Router) findPeer(host datatype.DiameterIdentity) (*Pool, *poolPeer) {
+	if host == "" {
+		return nil, nil
+	}
+	var foundPool *Pool
+	var found *poolPeer
+	_, pools := r.table()
+	for _, pool := range pools {
+		for _, peer := range pool.peerList() {
+			if peer.client.config.DestinationHost != host && peer.client.PeerCapabilities().OriginHost != host {
+				continue
+			}
+			if peer.client.WatchdogState() == WatchdogOkay {
+				return pool, peer
+			}
+			if found == nil {
+				foundPool, found = pool, peer
+			}
+		}
+	}
+	return foundPool, found
+}
+
+// diameterURIHost extracts the FQDN of a DiameterURI such as
+// "aaa://host.example.com:3868;transport=tcp".
+func diameterURIHost(uri datatype.DiameterURI) datatype.DiameterIdentity {
+	s := string(uri)
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+len("://"):]
+	}
+	if i := strings.IndexAny(s, ":;"); i >= 0 {
+		s = s[:i]
+	}
+	return datatype.DiameterIdentity(s)
+}
+
+// Shutdown stops accepting requests, waits for the outstanding ones and then
+// shuts every route down concurrently.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.acceptMu.Lock()
+	r.closing = true
+	r.acceptMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		r.Close()
+		return ctx.Err()
+	}
+
+	_, pools := r.table()
+	errCh := make(chan error, len(pools))
+	for _, pool := range pools {
+		go func(p *Pool) {
+			errCh <- p.Shutdown(ctx)
+		}(pool)
+	}
+	var err error
+	for range pools {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *Router) Close() {
+	r.acceptMu.Lock()
+	r.closing = true
+	r.acceptMu.Unlock()
+
+	_, pools := r.table()
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
@@ -0,0 +1,290 @@
+package dcc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+func NewTestRouter(routes ...Route) *Router {
+	return NewRouter(RoutingConfig{
+		DiameterConfig: DiameterConfig{
+			OriginHost:       datatype.DiameterIdentity("client"),
+			OriginRealm:      datatype.DiameterIdentity("localhost"),
+			DestinationRealm: datatype.DiameterIdentity("www.huawei.com"),
+			VendorID:         datatype.Unsigned32(0),
+			ProductName:      datatype.UTF8String("go-diameter"),
+			FirmwareRevision: datatype.Unsigned32(1),
+			WatchdogInterval: 100 * time.Millisecond,
+
+			ReconnectInterval:    10 * time.Millisecond,
+			MaxReconnectInterval: 100 * time.Millisecond,
+		},
+		Routes: routes,
+	})
+}
+
+func waitForRouterState(t *testing.T, r *Router, state WatchdogState) {
+	_, pools := r.table()
+	for _, pool := range pools {
+		waitForPoolState(t, pool, state)
+	}
+}
+
+// CaptureRequests answers every request of the server with Success and
+// returns the requests it received.
+func (s *Server) CaptureRequests(cmd string) <-chan *diam.Message {
+	requestCh := make(chan *diam.Message, 10)
+	s.mux.Handle(cmd, diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		requestCh <- m
+		answerMessage := m.Answer(diam.Success)
+		answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+		answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		answerMessage.WriteTo(conn)
+	}))
+	return requestCh
+}
+
+type realmRequest struct {
+	mockRequest
+	realm datatype.DiameterIdentity
+}
+
+func (r *realmRequest) DestinationRealm() datatype.DiameterIdentity {
+	return r.realm
+}
+
+func TestRouterRoutesByRealm(t *testing.T) {
+	prepaid := NewTestServer()
+	defer prepaid.Close()
+	prepaidCh := prepaid.CaptureRequests("CCR")
+	postpaid := NewTestServer()
+	defer postpaid.Close()
+	postpaidCh := postpaid.CaptureRequests("CCR")
+
+	router := NewTestRouter(
+		Route{Realm: "www.huawei.com", ApplicationID: 4, Peers: []PeerConfig{{URL: prepaid.Address, DestinationHost: "cbp"}}},
+		Route{Realm: "billing.dtac.co.th", ApplicationID: 4, Peers: []PeerConfig{{URL: postpaid.Address, DestinationHost: "bill"}}},
+	)
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	waitForRouterState(t, router, WatchdogOkay)
+
+	if _, err := router.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	request := &realmRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, realm: "billing.dtac.co.th"}
+	if _, err := router.Do(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ch    <-chan *diam.Message
+		realm datatype.DiameterIdentity
+		host  datatype.DiameterIdentity
+	}{
+		{prepaidCh, "www.huawei.com", "cbp"},
+		{postpaidCh, "billing.dtac.co.th", "bill"},
+	} {
+		select {
+		case m := <-c.ch:
+			realm, err := m.FindAVP(avp.DestinationRealm)
+			if err != nil || realm.Data != c.realm {
+				t.Errorf("Destination-Realm is %v, want %s", realm, c.realm)
+			}
+			host, err := m.FindAVP(avp.DestinationHost)
+			if err != nil || host.Data != c.host {
+				t.Errorf("Destination-Host is %v, want %s", host, c.host)
+			}
+		default:
+			t.Errorf("no request for realm %s", c.realm)
+		}
+	}
+}
+
+func TestRouterLookup(t *testing.T) {
+	router := NewTestRouter(
+		Route{Realm: "www.huawei.com", ApplicationID: 999, Action: RouteRelay},
+		Route{Realm: "www.huawei.com", Action: RouteProxy},
+		Route{Action: RouteRedirect},
+	)
+
+	hello := NewCommandRequest(Command{ApplicationID: 999, Code: 111})
+	if rt := router.lookup(hello); rt == nil || rt.action != RouteRelay {
+		t.Errorf("Hello-Message routed to %v", rt)
+	}
+	if rt := router.lookup(&mockRequest{}); rt == nil || rt.action != RouteProxy {
+		t.Errorf("CCR routed to %v", rt)
+	}
+	other := &realmRequest{realm: "elsewhere"}
+	if rt := router.lookup(other); rt == nil || rt.action != RouteRedirect {
+		t.Errorf("other realm routed to %v", rt)
+	}
+
+	router = NewTestRouter(Route{Realm: "www.huawei.com", ApplicationID: 4})
+	if _, err := router.Do(context.Background(), other); err != ErrNoRoute {
+		t.Errorf("expected ErrNoRoute, got %v", err)
+	}
+	if err := router.Serve(other); err != ErrNoRoute {
+		t.Errorf("expected ErrNoRoute, got %v", err)
+	}
+}
+
+func TestRouterRelayOmitsDestinationHost(t *testing.T) {
+	relay := NewTestServer()
+	defer relay.Close()
+	requestCh := relay.CaptureRequests("CCR")
+
+	router := NewTestRouter(Route{Action: RouteRelay, Peers: []PeerConfig{{URL: relay.Address, DestinationHost: "dra"}}})
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	waitForRouterState(t, router, WatchdogOkay)
+
+	request := &realmRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, realm: "far.away"}
+	if _, err := router.Do(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	m := <-requestCh
+	if _, err := m.FindAVP(avp.DestinationHost); err == nil {
+		t.Error("relayed request carries Destination-Host")
+	}
+	if realm, err := m.FindAVP(avp.DestinationRealm); err != nil || realm.Data != datatype.DiameterIdentity("far.away") {
+		t.Errorf("Destination-Realm is %v", realm)
+	}
+}
+
+func TestRouterFollowsRedirect(t *testing.T) {
+	agent := NewTestServer()
+	defer agent.Close()
+	redirectedCh := make(chan *diam.Message, 1)
+	agent.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		redirectedCh <- m
+		answerMessage := m.Answer(diam.RedirectIndication)
+		answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("redirect"))
+		answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+		answerMessage.NewAVP(avp.RedirectHost, avp.Mbit, 0, datatype.DiameterURI("aaa://unknown:3868;transport=tcp"))
+		answerMessage.NewAVP(avp.RedirectHost, avp.Mbit, 0, datatype.DiameterURI("aaa://target:3868;transport=tcp"))
+		answerMessage.WriteTo(conn)
+	}))
+	target := NewTestServer()
+	defer target.Close()
+	targetCh := target.CaptureRequests("CCR")
+
+	router := NewTestRouter(
+		Route{Realm: "www.huawei.com", Action: RouteRedirect, Peers: []PeerConfig{{URL: agent.Address}}},
+		Route{Realm: "target.realm", Peers: []PeerConfig{{URL: target.Address, DestinationHost: "target"}}},
+	)
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	waitForRouterState(t, router, WatchdogOkay)
+
+	answer, err := router.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resultCode, err := answer.FindAVP(avp.ResultCode); err != nil || resultCode.Data != datatype.Unsigned32(diam.Success) {
+		t.Errorf("unexpected answer %v", answer)
+	}
+	redirected := <-redirectedCh
+	select {
+	case m := <-targetCh:
+		if m.Header.EndToEndID != redirected.Header.EndToEndID {
+			t.Errorf("End-to-End ID changed from %d to %d", redirected.Header.EndToEndID, m.Header.EndToEndID)
+		}
+		if m.Header.CommandFlags&diam.RetransmittedFlag != 0 {
+			t.Error("redirected request has the T flag set")
+		}
+		before, _ := redirected.FindAVP(avp.SessionID)
+		after, err := m.FindAVP(avp.SessionID)
+		if err != nil || after.Data != before.Data {
+			t.Errorf("Session-Id changed from %v to %v", before, after)
+		}
+		pool := router.lookup(&realmRequest{realm: "target.realm"}).pool
+		pool.mu.Lock()
+		pin, ok := pool.sessions[before.Data.(datatype.UTF8String)]
+		pool.mu.Unlock()
+		if !ok || pin.peer.destinationHost != "target" {
+			t.Error("the session is not pinned to the redirect target")
+		}
+	default:
+		t.Error("redirect target received no CCR")
+	}
+}
+
+func TestRouterSharesPeerConnections(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	var cers int32
+	handleCER := server.HandleCER()
+	server.mux.Handle("CER", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		atomic.AddInt32(&cers, 1)
+		handleCER(conn, m)
+	}))
+	requestCh := server.CaptureRequests("CCR")
+
+	router := NewTestRouter(
+		Route{Realm: "www.huawei.com", Peers: []PeerConfig{{URL: server.Address, DestinationHost: "cbp"}}},
+		Route{Realm: "billing.dtac.co.th", Action: RouteRelay, Peers: []PeerConfig{{URL: server.Address}}},
+	)
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	waitForRouterState(t, router, WatchdogOkay)
+
+	if _, err := router.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	request := &realmRequest{mockRequest: mockRequest{outCh: make(chan *diam.Message, 1)}, realm: "billing.dtac.co.th"}
+	if _, err := router.Do(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&cers); n != 1 {
+		t.Errorf("peer received %d CERs, want 1", n)
+	}
+	if host, err := (<-requestCh).FindAVP(avp.DestinationHost); err != nil || host.Data != datatype.DiameterIdentity("cbp") {
+		t.Errorf("LOCAL route sent Destination-Host %v", host)
+	}
+	if _, err := (<-requestCh).FindAVP(avp.DestinationHost); err == nil {
+		t.Error("RELAY route sent a Destination-Host")
+	}
+
+	// Removing one of the routes keeps the connection of the other.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := router.Reload(ctx, []Route{{Realm: "www.huawei.com", Peers: []PeerConfig{{URL: server.Address, DestinationHost: "cbp"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-server.DisconnectNotify():
+		t.Error("the shared peer received a DPR")
+	default:
+	}
+	if _, err := router.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiameterURIHost(t *testing.T) {
+	for uri, host := range map[datatype.DiameterURI]datatype.DiameterIdentity{
+		"aaa://host.example.com:6666;transport=tcp": "host.example.com",
+		"aaas://host.example.com;transport=sctp":    "host.example.com",
+		"aaa://host.example.com":                    "host.example.com",
+	} {
+		if got := diameterURIHost(uri); got != host {
+			t.Errorf("%s: got %s, want %s", uri, got, host)
+		}
+	}
+}
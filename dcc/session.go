@@ -0,0 +1,84 @@
+package dcc
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+type SessionIDGenerator interface {
+	NextSessionID() datatype.UTF8String
+}
+
+// SessionRequest is implemented by requests that continue an existing
+// session instead of starting a new one.
+type SessionRequest interface {
+	Request
+	SessionID() datatype.UTF8String
+}
+
+// sessionIDGenerator builds Session-Ids in the format of RFC 6733 section
+// 8.8: <DiameterIdentity>;<high 32 bits>;<low 32 bits>[;<optional value>].
+// The high 32 bits start at the seed and the pair is incremented as one
+// 64-bit counter, so the low 32 bits carry into the high ones on wrap.
+type sessionIDGenerator struct {
+	prefix   string
+	suffix   string
+	sequence uint64
+}
+
+// NewSessionIDGenerator returns the default generator. Seed it with a value
+// that changes across restarts, such as the boot time in seconds, to keep
+// Session-Ids unique for the lifetime of identity.
+func NewSessionIDGenerator(identity datatype.DiameterIdentity, seed uint32, optional string) SessionIDGenerator {
+	g := &sessionIDGenerator{
+		prefix:   string(identity) + ";",
+		sequence: uint64(seed) << 32,
+	}
+	if optional != "" {
+		g.suffix = ";" + optional
+	}
+	return g
+}
+
+func (g *sessionIDGenerator) NextSessionID() datatype.UTF8String {
+	n := atomic.AddUint64(&g.sequence, 1)
+	high := strconv.FormatUint(n>>32, 10)
+	low := strconv.FormatUint(n&0xffffffff, 10)
+	return datatype.UTF8String(g.prefix + high + ";" + low + g.suffix)
+}
+
+func (d *diameterClient) sessionID(request Request) datatype.UTF8String {
+	return nextSessionID(request, d.sessions)
+}
+
+// nextSessionID returns the Session-Id of a SessionRequest, or a new one
+// from generator.
+func nextSessionID(request Request, generator SessionIDGenerator) datatype.UTF8String {
+	if r, ok := request.(SessionRequest); ok {
+		if id := r.SessionID(); id != "" {
+			return id
+		}
+	}
+	return generator.NextSessionID()
+}
+
+// CC-Request-Type values of RFC 4006 section 8.3 that end a session.
+const (
+	ccTerminationRequest = datatype.Enumerated(3)
+	ccEventRequest       = datatype.Enumerated(4)
+)
+
+// sessionEnds reports whether request is the last of its session: a
+// CC-Request-Type of TERMINATION_REQUEST or EVENT_REQUEST.
+func sessionEnds(request Request) bool {
+	for _, a := range request.AVP() {
+		if a.Code == avp.CCRequestType && a.VendorID == 0 {
+			t, ok := a.Data.(datatype.Enumerated)
+			return ok && (t == ccTerminationRequest || t == ccEventRequest)
+		}
+	}
+	return false
+}
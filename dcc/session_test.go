@@ -0,0 +1,104 @@
+package dcc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+func TestSessionIDFormat(t *testing.T) {
+	g := NewSessionIDGenerator("client.localhost", 1876543210, "")
+	if id := g.NextSessionID(); id != "client.localhost;1876543210;1" {
+		t.Errorf("unexpected Session-Id %s", id)
+	}
+	if id := g.NextSessionID(); id != "client.localhost;1876543210;2" {
+		t.Errorf("unexpected Session-Id %s", id)
+	}
+
+	g = NewSessionIDGenerator("client.localhost", 7, "omr")
+	if id := g.NextSessionID(); id != "client.localhost;7;1;omr" {
+		t.Errorf("unexpected Session-Id %s", id)
+	}
+}
+
+func TestSessionIDCarriesIntoHighBits(t *testing.T) {
+	g := &sessionIDGenerator{
+		prefix:   "client;",
+		sequence: 5<<32 | 0xfffffffe,
+	}
+	if id := g.NextSessionID(); id != "client;5;4294967295" {
+		t.Errorf("unexpected Session-Id %s", id)
+	}
+	if id := g.NextSessionID(); id != "client;6;0" {
+		t.Errorf("unexpected Session-Id %s", id)
+	}
+}
+
+func TestSessionIDUnique(t *testing.T) {
+	g := NewSessionIDGenerator("client", 0, "")
+	seen := make(map[datatype.UTF8String]bool)
+	for i := 0; i < 1000; i++ {
+		id := g.NextSessionID()
+		if seen[id] {
+			t.Fatalf("duplicate Session-Id %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestClientUsesRequestSessionID(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	ccrCh := make(chan *diam.Message, 2)
+	handleCCR := server.HandleCCR()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		ccrCh <- m
+		handleCCR(conn, m)
+	}))
+
+	client := NewTestClient(server.Address)
+	client.config.OriginHost = "client.localhost"
+	client.sessions = NewSessionIDGenerator("client.localhost", 42, "")
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := client.Do(ctx, &mockRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(ctx, &sessionRequest{sessionID: "client.localhost;1;99"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []datatype.UTF8String{"client.localhost;42;1", "client.localhost;1;99"} {
+		m := <-ccrCh
+		sessionID, err := m.FindAVP(avp.SessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionID.Data != expected {
+			t.Errorf("expected Session-Id %s, got %s", expected, sessionID.Data)
+		}
+	}
+}
+
+type sessionRequest struct {
+	mockRequest
+	sessionID datatype.UTF8String
+}
+
+func (r *sessionRequest) SessionID() datatype.UTF8String {
+	return r.sessionID
+}
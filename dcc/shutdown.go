@@ -0,0 +1,104 @@
+package dcc
+
+import (
+	"context"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// Disconnect-Cause values from RFC 6733 section 5.4.3.
+const (
+	DisconnectCauseRebooting            = datatype.Enumerated(0)
+	DisconnectCauseBusy                 = datatype.Enumerated(1)
+	DisconnectCauseDoNotWantToTalkToYou = datatype.Enumerated(2)
+)
+
+// Shutdown stops accepting requests, waits for the outstanding ones to be
+// answered and stops every background goroutine, then sends a DPR carrying
+// the configured DisconnectCause and waits for the DPA before closing the
+// connection. If ctx expires first, the connection is closed anyway and
+// ctx.Err() is returned.
+func (d *diameterClient) Shutdown(ctx context.Context) error {
+	d.acceptMu.Lock()
+	d.closing = true
+	d.acceptMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		d.Close()
+		return ctx.Err()
+	}
+
+	d.stop()
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		d.Close()
+		return ctx.Err()
+	}
+
+	var err error
+	if d.sendDPR(d.config.DisconnectCause) {
+		select {
+		case <-d.dpaCh:
+		case <-d.closeNotify():
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	d.Close()
+	return err
+}
+
+func (d *diameterClient) sendDPR(cause datatype.Enumerated) bool {
+	conn := d.connection()
+	if conn == nil {
+		return false
+	}
+
+	m := diam.NewRequest(diam.DisconnectPeer, 0, d.dictionary())
+
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
+	m.NewAVP(avp.DisconnectCause, avp.Mbit, 0, cause)
+
+	_, err := m.WriteTo(conn)
+	d.logMessage(LogRequestSent, m, 0, err)
+	return err == nil
+}
+
+func (d *diameterClient) handleDPA() diam.HandlerFunc {
+	return func(conn diam.Conn, m *diam.Message) {
+		d.logMessage(LogAnswerReceived, m, 0, nil)
+		select {
+		case d.dpaCh <- m:
+		default:
+		}
+	}
+}
+
+func (d *diameterClient) handleDPR() diam.HandlerFunc {
+	return func(conn diam.Conn, m *diam.Message) {
+		d.receivedTraffic()
+		d.logMessage(LogRequestReceived, m, 0, nil)
+		answerMessage := m.Answer(diam.Success)
+		answerMessage.NewAVP(avp.OriginHost, avp.Mbit, 0, d.config.OriginHost)
+		answerMessage.NewAVP(avp.OriginRealm, avp.Mbit, 0, d.config.OriginRealm)
+		d.writeAnswer(conn, answerMessage)
+	}
+}
@@ -0,0 +1,98 @@
+package dcc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+)
+
+func TestClientShutdownSendsDPR(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	client := NewTestClient(server.Address)
+	client.config.DisconnectCause = DisconnectCauseBusy
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-server.DisconnectNotify():
+		cause, err := m.FindAVP(avp.DisconnectCause)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cause.Data != DisconnectCauseBusy {
+			t.Errorf("unexpected Disconnect-Cause %v", cause.Data)
+		}
+	default:
+		t.Fatal("server did not receive a DPR")
+	}
+
+	select {
+	case <-client.closeNotify():
+	default:
+		t.Error("connection is still open")
+	}
+
+	if err := client.Serve(&mockRequest{}); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if _, err := client.Do(ctx, &mockRequest{}); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestClientShutdownDrainsOutstandingRequests(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	handleCCR := server.HandleCCR()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		time.Sleep(100 * time.Millisecond)
+		handleCCR(conn, m)
+	}))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Do(context.Background(), &mockRequest{})
+		done <- err
+	}()
+	for client.pending.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("outstanding request failed: %v", err)
+	}
+}
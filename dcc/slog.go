@@ -0,0 +1,66 @@
+package dcc
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that writes every LogEntry to logger, with
+// the event as the message and the fields that apply as attributes.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+func (l slogLogger) Log(e LogEntry) {
+	attrs := []slog.Attr{slog.String("peer", e.Peer)}
+	if e.Event == LogStateChanged {
+		attrs = append(attrs,
+			slog.String("state", e.State.String()),
+			slog.String("previous_state", e.PreviousState.String()),
+		)
+	}
+	if e.Command != (Command{}) || e.CommandName != "" {
+		attrs = append(attrs,
+			slog.Uint64("application_id", uint64(e.Command.ApplicationID)),
+			slog.Uint64("command_code", uint64(e.Command.Code)),
+		)
+	}
+	if e.CommandName != "" {
+		attrs = append(attrs, slog.String("command", e.CommandName))
+	}
+	if e.HopByHopID != 0 || e.EndToEndID != 0 {
+		attrs = append(attrs,
+			slog.Uint64("hop_by_hop_id", uint64(e.HopByHopID)),
+			slog.Uint64("end_to_end_id", uint64(e.EndToEndID)),
+		)
+	}
+	if e.SessionID != "" {
+		attrs = append(attrs, slog.String("session_id", string(e.SessionID)))
+	}
+	if e.ResultCode != 0 {
+		attrs = append(attrs, slog.Uint64("result_code", uint64(e.ResultCode)))
+	}
+	if e.Latency != 0 {
+		attrs = append(attrs, slog.Duration("latency", e.Latency))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+	}
+	l.logger.LogAttrs(context.Background(), slogLevel(e.Level), e.Event.String(), attrs...)
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogDebug:
+		return slog.LevelDebug
+	case LogWarn:
+		return slog.LevelWarn
+	case LogError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
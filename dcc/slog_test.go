@@ -0,0 +1,55 @@
+package dcc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	logger.Log(LogEntry{Event: LogRequestSent, Level: LogDebug, Peer: "srv", Command: CreditControlCommand})
+	if buf.Len() != 0 {
+		t.Errorf("debug entry written at the default slog level: %s", buf.String())
+	}
+
+	logger.Log(LogEntry{
+		Event:       LogAnswerReceived,
+		Level:       LogWarn,
+		Peer:        "srv",
+		Command:     CreditControlCommand,
+		CommandName: "Credit-Control",
+		SessionID:   "client;1;1",
+		ResultCode:  5030,
+		Latency:     3 * time.Millisecond,
+		Err:         errors.New("boom"),
+	})
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"level":          "WARN",
+		"msg":            "answer received",
+		"peer":           "srv",
+		"command":        "Credit-Control",
+		"application_id": float64(4),
+		"command_code":   float64(272),
+		"session_id":     "client;1;1",
+		"result_code":    float64(5030),
+		"latency":        float64(3 * time.Millisecond),
+		"error":          "boom",
+	} {
+		if record[key] != want {
+			t.Errorf("%s = %v, want %v", key, record[key], want)
+		}
+	}
+	if _, ok := record["state"]; ok {
+		t.Error("state logged for an answer")
+	}
+}
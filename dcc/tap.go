@@ -0,0 +1,76 @@
+package dcc
+
+import (
+	"net"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+)
+
+type Direction int
+
+const (
+	Outbound Direction = iota
+	Inbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "OUT"
+	case Inbound:
+		return "IN"
+	}
+	return "UNKNOWN"
+}
+
+// TappedMessage is a message written to or read from the peer. Raw holds the
+// exact bytes of the message, before TLS encryption; Message is nil when they
+// could not be decoded.
+type TappedMessage struct {
+	Direction  Direction
+	Time       time.Time
+	Message    *diam.Message
+	Raw        []byte
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// Tap receives every message of the connections of a client. Outbound
+// messages are tapped once they are written. It is called from the client's
+// goroutines, including the connection's read loop, and should return
+// quickly.
+type Tap interface {
+	Tap(TappedMessage)
+}
+
+// TapFunc adapts a function to the Tap interface.
+type TapFunc func(TappedMessage)
+
+func (f TapFunc) Tap(m TappedMessage) {
+	f(m)
+}
+
+func (c *peerConn) tapMessage(direction Direction, m *diam.Message, raw []byte) {
+	c.tap.Tap(TappedMessage{
+		Direction:  direction,
+		Time:       time.Now(),
+		Message:    m,
+		Raw:        raw,
+		LocalAddr:  c.rwc.LocalAddr(),
+		RemoteAddr: c.rwc.RemoteAddr(),
+	})
+}
+
+// tapWrite taps a message written with diam.Message.WriteTo, which hands
+// every message to Write in one call.
+func (c *peerConn) tapWrite(b []byte) {
+	raw := append([]byte(nil), b...)
+	var m *diam.Message
+	if h, err := diam.DecodeHeader(raw); err == nil && int(h.MessageLength) == len(raw) {
+		if decoded, err := c.decodeMessage(h, raw); err == nil {
+			m = decoded
+		}
+	}
+	c.tapMessage(Outbound, m, raw)
+}
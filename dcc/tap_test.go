@@ -0,0 +1,85 @@
+package dcc
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam"
+)
+
+type recordingTap struct {
+	mu       sync.Mutex
+	messages []TappedMessage
+}
+
+func (r *recordingTap) Tap(m TappedMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m)
+}
+
+func (r *recordingTap) find(direction Direction, code uint32) (TappedMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.messages {
+		if m.Direction == direction && m.Message != nil && m.Message.Header.CommandCode == code {
+			return m, true
+		}
+	}
+	return TappedMessage{}, false
+}
+
+func TestClientTapsMessages(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	tap := &recordingTap{}
+	client := NewTestClient(server.Address)
+	client.config.Tap = tap
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		direction Direction
+		code      uint32
+	}{
+		{Outbound, diam.CapabilitiesExchange},
+		{Inbound, diam.CapabilitiesExchange},
+		{Outbound, diam.CreditControl},
+		{Inbound, diam.CreditControl},
+	} {
+		m, ok := tap.find(c.direction, c.code)
+		if !ok {
+			t.Errorf("%s command %d was not tapped", c.direction, c.code)
+			continue
+		}
+		// Only the header is compared: go-diameter does not zero the AVP
+		// padding it writes, so the raw bytes can differ from Serialize.
+		serialized, err := m.Message.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Raw) != len(serialized) || !bytes.Equal(m.Raw[:diam.HeaderLength], serialized[:diam.HeaderLength]) {
+			t.Errorf("%s command %d: raw bytes differ from the message", c.direction, c.code)
+		}
+		if m.Time.IsZero() || m.LocalAddr == nil || m.RemoteAddr.String() != server.Address {
+			t.Errorf("%s command %d: unexpected metadata %v %v %v", c.direction, c.code, m.Time, m.LocalAddr, m.RemoteAddr)
+		}
+	}
+
+	cer, _ := tap.find(Outbound, diam.CapabilitiesExchange)
+	cea, _ := tap.find(Inbound, diam.CapabilitiesExchange)
+	if cea.Time.Before(cer.Time) {
+		t.Error("CEA tapped before the CER")
+	}
+}
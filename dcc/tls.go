@@ -0,0 +1,72 @@
+package dcc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+// TLSConfig enables TLS on the connection to the peer. The files are read on
+// every connection attempt, so renewed certificates are picked up when the
+// client reconnects.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the CAs trusted to sign the peer certificate.
+	// When empty the system roots are used.
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName is the name the peer certificate is checked against. It
+	// defaults to DestinationHost, or to the host of URL when that is empty.
+	ServerName string
+	// MinVersion defaults to tls.VersionTLS12.
+	MinVersion uint16
+}
+
+var ErrNoCertificates = errors.New("dcc: no certificates found in CA bundle")
+
+func (d *diameterClient) tlsConfig() (*tls.Config, error) {
+	c := d.config.TLS
+	if c == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: c.MinVersion,
+	}
+	if config.ServerName == "" {
+		config.ServerName = string(d.config.DestinationHost)
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(d.config.URL)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if c.CAFile != "" {
+		bundle, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, ErrNoCertificates
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,223 @@
+package dcc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// testPKI is a throwaway CA with a server certificate for "srv" and a client
+// certificate, written as PEM files to dir.
+type testPKI struct {
+	dir    string
+	pool   *x509.CertPool
+	server tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "dcc-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := &testPKI{dir: dir, pool: x509.NewCertPool()}
+
+	caKey, caCert, caDER := pki.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	pki.pool.AddCert(caCert)
+	pki.write(t, "ca.pem", "CERTIFICATE", caDER)
+
+	serverKey, _, serverDER := pki.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "srv"},
+		DNSNames:    []string{"srv"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	pki.server = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	clientKey, _, clientDER := pki.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+	pki.write(t, "client.pem", "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.write(t, "client.key", "EC PRIVATE KEY", keyDER)
+	return pki
+}
+
+func (pki *testPKI) issue(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert, der
+}
+
+func (pki *testPKI) write(t *testing.T, name, blockType string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(pki.path(name), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (pki *testPKI) path(name string) string {
+	return filepath.Join(pki.dir, name)
+}
+
+func (pki *testPKI) Close() {
+	os.RemoveAll(pki.dir)
+}
+
+func (pki *testPKI) serverConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{pki.server}}
+}
+
+func connectTLS(address string, destinationHost datatype.DiameterIdentity, config *TLSConfig) (*diameterClient, error) {
+	client := NewTestClient(address)
+	client.config.DestinationHost = destinationHost
+	client.config.TLS = config
+	if err := client.Start(); err != nil {
+		return nil, err
+	}
+	if err := client.Init(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func TestClientTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+	server := NewTestTLSServer(pki.serverConfig())
+	defer server.Close()
+
+	client, err := connectTLS(server.Address, "srv", &TLSConfig{CAFile: pki.path("ca.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	state := client.connection().TLS()
+	if state == nil || !state.HandshakeComplete {
+		t.Fatal("connection is not TLS")
+	}
+	if state.Version < tls.VersionTLS12 {
+		t.Errorf("negotiated TLS version %x", state.Version)
+	}
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTLSChecksDestinationHost(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+	server := NewTestTLSServer(pki.serverConfig())
+	defer server.Close()
+
+	if client, err := connectTLS(server.Address, "other", &TLSConfig{CAFile: pki.path("ca.pem")}); err == nil {
+		client.Close()
+		t.Fatal("connected to a peer whose certificate does not match DestinationHost")
+	}
+	if client, err := connectTLS(server.Address, "other", &TLSConfig{CAFile: pki.path("ca.pem"), ServerName: "srv"}); err != nil {
+		t.Fatal(err)
+	} else {
+		client.Close()
+	}
+}
+
+func TestClientTLSRejectsUnknownCA(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+	other := newTestPKI(t)
+	defer other.Close()
+	server := NewTestTLSServer(pki.serverConfig())
+	defer server.Close()
+
+	if client, err := connectTLS(server.Address, "srv", &TLSConfig{CAFile: other.path("ca.pem")}); err == nil {
+		client.Close()
+		t.Fatal("connected to a peer signed by an untrusted CA")
+	}
+}
+
+func TestClientMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+	config := pki.serverConfig()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = pki.pool
+	server := NewTestTLSServer(config)
+	defer server.Close()
+
+	if client, err := connectTLS(server.Address, "srv", &TLSConfig{CAFile: pki.path("ca.pem")}); err == nil {
+		client.Close()
+		t.Fatal("connected without a client certificate")
+	}
+
+	client, err := connectTLS(server.Address, "srv", &TLSConfig{
+		CAFile:   pki.path("ca.pem"),
+		CertFile: pki.path("client.pem"),
+		KeyFile:  pki.path("client.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTLSMinVersion(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+	config := pki.serverConfig()
+	config.MaxVersion = tls.VersionTLS12
+	server := NewTestTLSServer(config)
+	defer server.Close()
+
+	if client, err := connectTLS(server.Address, "srv", &TLSConfig{CAFile: pki.path("ca.pem"), MinVersion: tls.VersionTLS13}); err == nil {
+		client.Close()
+		t.Fatal("connected below the minimum TLS version")
+	}
+}
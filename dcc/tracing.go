@@ -0,0 +1,94 @@
+package dcc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/skyfoxs/diameter-sample/dcc"
+
+// transactionSpanKey marks a context that already carries the span of a
+// transaction, so that a Router calling a Pool does not start a second one.
+type transactionSpanKey struct{}
+
+// startSpan starts the client span of a Diameter transaction as a child of
+// the span in ctx. The returned function records the answer or error and
+// ends the span; it does nothing when the transaction belongs to an outer
+// span.
+func startSpan(ctx context.Context, config DiameterConfig, request Request) (context.Context, func(*diam.Message, error)) {
+	if ctx.Value(transactionSpanKey{}) != nil {
+		return ctx, func(*diam.Message, error) {}
+	}
+
+	provider := config.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	command := requestCommand(request)
+	name := requestName(config, request)
+
+	ctx, span := provider.Tracer(tracerName).Start(ctx, "diameter "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("diameter.command", name),
+			attribute.Int64("diameter.command_code", int64(command.Code)),
+			attribute.Int64("diameter.application_id", int64(command.ApplicationID)),
+		),
+	)
+	ctx = context.WithValue(ctx, transactionSpanKey{}, true)
+	return ctx, func(m *diam.Message, err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if m != nil {
+			code := resultCode(m)
+			span.SetAttributes(attribute.Int64("diameter.result_code", int64(code)))
+			if code >= 3000 {
+				span.SetStatus(codes.Error, fmt.Sprintf("Result-Code %d", code))
+			}
+		}
+		span.End()
+	}
+}
+
+// traceRequest records on the span of t the peer a request is written to.
+// Requests that are written again after a failover get a retransmission
+// event.
+func (d *diameterClient) traceRequest(t *transaction, m *diam.Message) {
+	span := trace.SpanFromContext(t.ctx)
+	if !span.IsRecording() {
+		return
+	}
+	peer := attribute.String("diameter.peer", d.peerName())
+	if m.Header.CommandFlags&diam.RetransmittedFlag != 0 {
+		span.AddEvent("retransmission", trace.WithAttributes(peer))
+	}
+	span.SetAttributes(
+		peer,
+		attribute.String("diameter.session_id", string(t.sessionID)),
+		attribute.Int64("diameter.hop_by_hop_id", int64(m.Header.HopByHopID)),
+		attribute.Int64("diameter.end_to_end_id", int64(m.Header.EndToEndID)),
+	)
+}
+
+// requestName is the dictionary name of the command of request, or its code
+// when the dictionary does not define it.
+func requestName(config DiameterConfig, request Request) string {
+	command := requestCommand(request)
+	dp := config.Dictionary
+	if dp == nil {
+		dp = dict.Default
+	}
+	if c, err := dp.FindCommand(command.ApplicationID, command.Code); err == nil {
+		return c.Name
+	}
+	return strconv.FormatUint(uint64(command.Code), 10)
+}
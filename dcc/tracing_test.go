@@ -0,0 +1,173 @@
+package dcc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, a := range span.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span %s in %v", name, exporter.GetSpans())
+	return tracetest.SpanStub{}
+}
+
+func TestClientDoStartsSpan(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	provider, exporter := newTestTracerProvider()
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.TracerProvider = provider
+	})
+	defer client.Close()
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "front-end")
+	if _, err := client.Do(ctx, &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	span := findSpan(t, exporter, "diameter Credit-Control")
+	if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("transaction span is not a child of the caller's span")
+	}
+	if span.SpanKind != trace.SpanKindClient {
+		t.Errorf("span kind %v", span.SpanKind)
+	}
+	for key, want := range map[attribute.Key]attribute.Value{
+		"diameter.command":        attribute.StringValue("Credit-Control"),
+		"diameter.application_id": attribute.Int64Value(4),
+		"diameter.peer":           attribute.StringValue("srv"),
+		"diameter.result_code":    attribute.Int64Value(diam.Success),
+	} {
+		if got := spanAttribute(span, key); got != want {
+			t.Errorf("%s = %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+	if spanAttribute(span, "diameter.session_id").AsString() == "" {
+		t.Error("span has no Session-Id")
+	}
+	if span.Status.Code == codes.Error {
+		t.Errorf("unexpected status %v", span.Status)
+	}
+}
+
+func TestClientServeContextOutlivesCanceledContext(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	provider, exporter := newTestTracerProvider()
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.TracerProvider = provider
+	})
+	defer client.Close()
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "front-end")
+	ctx, cancel := context.WithCancel(ctx)
+	request := &mockRequest{outCh: make(chan *diam.Message, 1)}
+	if err := client.ServeContext(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	parent.End()
+
+	select {
+	case <-request.ResponseNotify():
+	case <-time.After(time.Second):
+		t.Fatal("no answer after the caller's context was canceled")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(exporter.GetSpans()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	span := findSpan(t, exporter, "diameter Credit-Control")
+	if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("transaction span is not a child of the caller's span")
+	}
+}
+
+func TestClientSpanRecordsTimeout(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("CCR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+	provider, exporter := newTestTracerProvider()
+	client := startTestClient(t, server, func(c *DiameterConfig) {
+		c.TracerProvider = provider
+		c.TxTimeout = 50 * time.Millisecond
+	})
+	defer client.Close()
+
+	client.Do(context.Background(), &mockRequest{})
+	span := findSpan(t, exporter, "diameter Credit-Control")
+	if span.Status.Code != codes.Error {
+		t.Errorf("unexpected status %v", span.Status)
+	}
+	if len(span.Events) != 1 || span.Events[0].Name != "exception" {
+		t.Errorf("error was not recorded: %v", span.Events)
+	}
+}
+
+func TestPoolSpanRecordsFailover(t *testing.T) {
+	primary := NewTestServer()
+	defer primary.Close()
+	primary.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		conn.Close()
+	}))
+	secondary := NewTestServer()
+	defer secondary.Close()
+
+	provider, exporter := newTestTracerProvider()
+	pool := NewTestPool(RoundRobin,
+		PeerConfig{URL: primary.Address, DestinationHost: "primary"},
+		PeerConfig{URL: secondary.Address, DestinationHost: "secondary", Priority: 1},
+	)
+	pool.config.TracerProvider = provider
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitForPoolState(t, pool, WatchdogOkay)
+
+	if _, err := pool.Do(context.Background(), &mockRequest{outCh: make(chan *diam.Message, 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans for one transaction", len(spans))
+	}
+	var events []string
+	for _, e := range spans[0].Events {
+		events = append(events, e.Name)
+	}
+	if len(events) != 2 || events[0] != "failover" || events[1] != "retransmission" {
+		t.Errorf("unexpected events %v", events)
+	}
+	if peer := spanAttribute(spans[0], "diameter.peer").AsString(); peer != "secondary" {
+		t.Errorf("span names peer %s", peer)
+	}
+}
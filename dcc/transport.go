@@ -0,0 +1,194 @@
+package dcc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// peerConn is the client side of a Diameter connection. Unlike the Conn
+// returned by diam.Dial it reports every read error, including EOF, by
+// closing the channel returned from CloseNotify.
+type peerConn struct {
+	rwc     net.Conn
+	reader  *bufio.Reader
+	handler diam.Handler
+	dict    *dict.Parser
+	tap     Tap
+	// recovered, if set, is told about the panics of handler. The message
+	// that caused one is dropped and the connection stays up.
+	recovered func(m *diam.Message, v interface{})
+	// failed, if set, is told why the connection stopped being read, unless
+	// it was closed on either side. m holds the header of a message that
+	// could not be decoded, and is nil when none could be read.
+	failed func(m *diam.Message, err error)
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// dial connects to addr, giving up after timeout, and serves the messages of
+// the peer on the returned connection as newPeerConn does.
+func dial(addr string, timeout time.Duration, config *tls.Config, c *peerConn) (*peerConn, error) {
+	if len(addr) == 0 {
+		addr = ":3868"
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var rwc net.Conn
+	var err error
+	if config != nil {
+		rwc, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		rwc, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newPeerConn(rwc, c), nil
+}
+
+// newPeerConn serves the messages read from rwc with the handler, dict, tap
+// and recovered of c.
+func newPeerConn(rwc net.Conn, c *peerConn) *peerConn {
+	c.rwc = rwc
+	c.reader = bufio.NewReader(rwc)
+	if c.dict == nil {
+		c.dict = dict.Default
+	}
+	c.closeCh = make(chan struct{})
+	go c.serve()
+	return c
+}
+
+var errMessageLength = errors.New("dcc: message length is shorter than the header")
+
+func (c *peerConn) serve() {
+	defer c.Close()
+	for {
+		m, err := c.readMessage()
+		if err != nil {
+			c.readFailed(m, err)
+			return
+		}
+		c.serveMessage(m)
+	}
+}
+
+func (c *peerConn) readFailed(m *diam.Message, err error) {
+	select {
+	case <-c.closeCh:
+		return
+	default:
+	}
+	if c.failed != nil && err != io.EOF {
+		c.failed(m, err)
+	}
+}
+
+func (c *peerConn) serveMessage(m *diam.Message) {
+	defer func() {
+		if v := recover(); v != nil && c.recovered != nil {
+			c.recovered(m, v)
+		}
+	}()
+	c.handler.ServeDIAM(c, m)
+}
+
+// readMessage reads a whole message before parsing it, so that a command
+// missing from the dictionary does not leave its body in the stream. Such a
+// message is returned with its header and the AVPs that could be decoded, and
+// reaches the "ALL" handler of the mux.
+func (c *peerConn) readMessage() (*diam.Message, error) {
+	b := make([]byte, diam.HeaderLength)
+	if _, err := io.ReadFull(c.reader, b); err != nil {
+		return nil, err
+	}
+	h, err := diam.DecodeHeader(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if h.MessageLength < diam.HeaderLength {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, errMessageLength)
+	}
+	b = append(b, make([]byte, h.MessageLength-diam.HeaderLength)...)
+	if _, err := io.ReadFull(c.reader, b[diam.HeaderLength:]); err != nil {
+		return nil, err
+	}
+
+	m, err := c.decodeMessage(h, b)
+	if c.tap != nil {
+		if err != nil {
+			c.tapMessage(Inbound, nil, b)
+		} else {
+			c.tapMessage(Inbound, m, b)
+		}
+	}
+	if err != nil {
+		m = diam.NewMessage(h.CommandCode, h.CommandFlags, h.ApplicationID, h.HopByHopID, h.EndToEndID, c.dict)
+		return m, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	return m, nil
+}
+
+func (c *peerConn) decodeMessage(h *diam.Header, b []byte) (*diam.Message, error) {
+	if _, err := c.dict.FindCommand(h.ApplicationID, h.CommandCode); err != nil {
+		m := diam.NewMessage(h.CommandCode, h.CommandFlags, h.ApplicationID, h.HopByHopID, h.EndToEndID, c.dict)
+		for body := b[diam.HeaderLength:]; len(body) > 0; {
+			a, err := diam.DecodeAVP(body, h.ApplicationID, c.dict)
+			if err != nil || a.Len() > len(body) {
+				break
+			}
+			m.AVP = append(m.AVP, a)
+			body = body[a.Len():]
+		}
+		return m, nil
+	}
+	return diam.ReadMessage(bytes.NewReader(b), c.dict)
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.rwc.Write(b)
+	if err == nil && c.tap != nil {
+		c.tapWrite(b)
+	}
+	return n, err
+}
+
+func (c *peerConn) Close() {
+	c.closeOnce.Do(func() {
+		c.rwc.Close()
+		close(c.closeCh)
+	})
+}
+
+func (c *peerConn) CloseNotify() <-chan struct{} {
+	return c.closeCh
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	return c.rwc.LocalAddr()
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.rwc.RemoteAddr()
+}
+
+func (c *peerConn) TLS() *tls.ConnectionState {
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package dcc
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+func TestDialTimeout(t *testing.T) {
+	// The listener completes the TCP handshake but never the TLS one.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	if _, err := dial(listener.Addr().String(), 50*time.Millisecond, &tls.Config{InsecureSkipVerify: true}, &peerConn{}); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial gave up after %v", elapsed)
+	}
+}
+
+func TestPeerConnRecoversHandlerPanic(t *testing.T) {
+	client := NewTestClient("")
+	client.handler.Handle("RAR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		panic("bad RAR")
+	}))
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	rar := diam.NewRequest(diam.ReAuth, 4, dict.Default)
+	rar.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("client;1;1"))
+	if _, err := rar.WriteTo(peer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-client.ErrorNotify():
+		var e *Error
+		if !errors.Is(err, ErrHandlerPanic) || !errors.As(err, &e) || e.Command.Code != diam.ReAuth {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic was not reported")
+	}
+
+	// The connection keeps serving the following messages.
+	dwr := diam.NewRequest(diam.DeviceWatchdog, 0, dict.Default)
+	dwr.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("srv"))
+	dwr.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	if _, err := dwr.WriteTo(peer); err != nil {
+		t.Fatal(err)
+	}
+	if dwa := readRawMessage(t, peer); dwa.Header.CommandCode != diam.DeviceWatchdog {
+		t.Errorf("expected a DWA, got %v", dwa)
+	}
+}
+
+func TestPeerConnReportsMalformedMessage(t *testing.T) {
+	client := NewTestClient("")
+	peer := pipeClient(client)
+	defer peer.Close()
+
+	cca := diam.NewMessage(diam.CreditControl, 0, 4, 1, 2, dict.Default)
+	cca.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("client;1;1"))
+	cca.NewAVP(99999, 0, 0, datatype.OctetString("unknown"))
+	go cca.WriteTo(peer)
+
+	select {
+	case err := <-client.ErrorNotify():
+		var e *Error
+		if !errors.Is(err, ErrMalformedMessage) || !errors.As(err, &e) || e.Kind != KindProtocol || e.Command.Code != diam.CreditControl {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("malformed message was not reported")
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection still open: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package dcc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// Violation is an AVP that occurs more or fewer times than the dictionary
+// allows. AVP is the path of the AVP, such as
+// "Multiple-Services-Credit-Control/Used-Service-Unit"; a grouped AVP that
+// occurs more than once is followed by the index of the occurrence, as in
+// "Subscription-Id[1]/Subscription-Id-Data". Max is zero when the AVP may be
+// repeated without limit.
+type Violation struct {
+	AVP   string
+	Count int
+	Min   int
+	Max   int
+}
+
+func (v Violation) String() string {
+	if v.Count < v.Min {
+		if v.Count == 0 {
+			return "missing " + v.AVP
+		}
+		return fmt.Sprintf("%s occurs %d times, at least %d required", v.AVP, v.Count, v.Min)
+	}
+	return fmt.Sprintf("%s occurs %d times, at most %d allowed", v.AVP, v.Count, v.Max)
+}
+
+// ValidationError is the cause of a request rejected by the client, or of an
+// answer rejected from the peer, because it breaks the rules the dictionary
+// gives for its command. It lists every violation, not only the first one.
+type ValidationError struct {
+	Command    Command
+	Answer     bool
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	violations := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		violations[i] = v.String()
+	}
+	message := "request"
+	if e.Answer {
+		message = "answer"
+	}
+	return fmt.Sprintf("dcc: %s for command %d of application %d breaks the dictionary rules: %s",
+		message, e.Command.Code, e.Command.ApplicationID, strings.Join(violations, "; "))
+}
+
+// validateMessage checks m against the request or answer rules of its
+// command in dp, descending into grouped AVPs. Commands the dictionary does
+// not know and answers with the E bit, which follow the generic
+// answer-message format of RFC 6733 section 7.2, are not checked. The
+// go-diameter dictionaries give no Vendor-Id for their AVPs, so the rules are
+// taken to name base AVPs: an AVP with a Vendor-Id never counts for a rule,
+// even when its code is that of the AVP the rule names.
+func validateMessage(dp *dict.Parser, m *diam.Message) error {
+	applicationID := m.Header.ApplicationID
+	cmd, err := dp.FindCommand(applicationID, m.Header.CommandCode)
+	if err != nil {
+		return nil
+	}
+	rules := cmd.Request.Rule
+	answer := m.Header.CommandFlags&diam.RequestFlag == 0
+	if answer {
+		if m.Header.CommandFlags&diam.ErrorFlag != 0 {
+			return nil
+		}
+		rules = cmd.Answer.Rule
+	}
+	violations := validateAVPs(dp, applicationID, "", rules, m.AVP)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{
+		Command:    Command{ApplicationID: applicationID, Code: m.Header.CommandCode},
+		Answer:     answer,
+		Violations: violations,
+	}
+}
+
+func validateAVPs(dp *dict.Parser, applicationID uint32, path string, rules []*dict.Rule, avps []*diam.AVP) []Violation {
+	type occurrence struct {
+		avp  *diam.AVP
+		data *dict.AVP
+	}
+	byName := make(map[string][]occurrence)
+	var names []string
+	for _, a := range avps {
+		if a.VendorID != 0 {
+			continue
+		}
+		data, err := dp.FindAVP(applicationID, a.Code)
+		if err != nil {
+			continue
+		}
+		if _, ok := byName[data.Name]; !ok {
+			names = append(names, data.Name)
+		}
+		byName[data.Name] = append(byName[data.Name], occurrence{a, data})
+	}
+
+	var violations []Violation
+	for _, rule := range rules {
+		min := rule.Min
+		if rule.Required && min == 0 {
+			min = 1
+		}
+		count := len(byName[rule.AVP])
+		if count < min || (rule.Max > 0 && count > rule.Max) {
+			violations = append(violations, Violation{AVP: path + rule.AVP, Count: count, Min: min, Max: rule.Max})
+		}
+	}
+
+	for _, name := range names {
+		occurrences := byName[name]
+		for i, o := range occurrences {
+			grouped, ok := o.avp.Data.(*diam.GroupedAVP)
+			if !ok || len(o.data.Data.Rule) == 0 {
+				continue
+			}
+			prefix := path + name
+			if len(occurrences) > 1 {
+				prefix += fmt.Sprintf("[%d]", i)
+			}
+			violations = append(violations, validateAVPs(dp, applicationID, prefix+"/", o.data.Data.Rule, grouped.AVP)...)
+		}
+	}
+	return violations
+}
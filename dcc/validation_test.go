@@ -0,0 +1,161 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+type avpRequest struct {
+	mockRequest
+	avps []*diam.AVP
+}
+
+func (r *avpRequest) AVP() []*diam.AVP {
+	return r.avps
+}
+
+func subscriptionID(avps ...*diam.AVP) *diam.AVP {
+	return diam.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{AVP: avps})
+}
+
+func validCCRAVPs() []*diam.AVP {
+	return []*diam.AVP{
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+		diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org")),
+		diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+		diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(0)),
+		subscriptionID(
+			diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(0)),
+			diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("5511999999999")),
+		),
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("client;1;1"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("client"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	for _, a := range validCCRAVPs() {
+		m.AddAVP(a)
+	}
+	if err := validateMessage(dict.Default, m); err != nil {
+		t.Fatalf("valid request rejected: %v", err)
+	}
+
+	m = diam.NewRequest(diam.CreditControl, 4, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("client;1;1"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("client"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("client"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4))
+	m.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1))
+	m.AddAVP(subscriptionID(diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(0))))
+	m.AddAVP(subscriptionID(
+		diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("a")),
+		diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("b")),
+	))
+
+	var verr *ValidationError
+	if err := validateMessage(dict.Default, m); !errors.As(err, &verr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := []Violation{
+		{AVP: "Origin-Host", Count: 2, Min: 1, Max: 1},
+		{AVP: "Service-Context-Id", Count: 0, Min: 1, Max: 1},
+		{AVP: "CC-Request-Number", Count: 0, Min: 1, Max: 1},
+		{AVP: "Subscription-Id", Count: 2, Min: 0, Max: 1},
+		{AVP: "Subscription-Id[0]/Subscription-Id-Data", Count: 0, Min: 1, Max: 1},
+		{AVP: "Subscription-Id[1]/Subscription-Id-Type", Count: 0, Min: 1, Max: 1},
+		{AVP: "Subscription-Id[1]/Subscription-Id-Data", Count: 2, Min: 1, Max: 1},
+	}
+	if !reflect.DeepEqual(verr.Violations, want) {
+		t.Errorf("violations\n%v\nwant\n%v", verr.Violations, want)
+	}
+	if verr.Command != CreditControlCommand {
+		t.Errorf("command %v", verr.Command)
+	}
+}
+
+func TestValidateMessageMatchesVendorID(t *testing.T) {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("client;1;1"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("client"))
+	m.NewAVP(avp.OriginHost, avp.Mbit|avp.Vbit, 10415, datatype.DiameterIdentity("client"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("localhost"))
+	for _, a := range validCCRAVPs() {
+		if a.Code == avp.ServiceContextID {
+			a = diam.NewAVP(avp.ServiceContextID, avp.Mbit|avp.Vbit, 10415, datatype.UTF8String("32251@3gpp.org"))
+		}
+		m.AddAVP(a)
+	}
+
+	var verr *ValidationError
+	if err := validateMessage(dict.Default, m); !errors.As(err, &verr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := []Violation{{AVP: "Service-Context-Id", Count: 0, Min: 1, Max: 1}}
+	if !reflect.DeepEqual(verr.Violations, want) {
+		t.Errorf("violations\n%v\nwant\n%v", verr.Violations, want)
+	}
+}
+
+func TestValidateMessageUnknownCommand(t *testing.T) {
+	m := diam.NewRequest(12345, 4, dict.Default)
+	if err := validateMessage(dict.Default, m); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientRejectsInvalidRequest(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	received := make(chan struct{}, 2)
+	server.mux.Handle("CCR", diam.HandlerFunc(func(conn diam.Conn, m *diam.Message) {
+		received <- struct{}{}
+		server.HandleCCR()(conn, m)
+	}))
+
+	client := NewTestClient(server.Address)
+	client.config.ValidateRequests = true
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := client.Do(context.Background(), &avpRequest{mockRequest{}, validCCRAVPs()[2:]})
+	var e *Error
+	if !errors.As(err, &e) || e.Kind != KindInvalidRequest {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Violations) != 2 {
+		t.Fatalf("unexpected violations in %v", err)
+	}
+	select {
+	case <-received:
+		t.Error("invalid request was sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := client.pending.len(); n != 0 {
+		t.Errorf("%d transactions still pending", n)
+	}
+
+	if _, err := client.Do(context.Background(), &avpRequest{mockRequest{outCh: make(chan *diam.Message, 1)}, validCCRAVPs()}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,157 @@
+package dcc
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type WatchdogState int
+
+const (
+	WatchdogInitial WatchdogState = iota
+	WatchdogOkay
+	WatchdogSuspect
+	WatchdogDown
+	WatchdogReopen
+)
+
+func (s WatchdogState) String() string {
+	switch s {
+	case WatchdogInitial:
+		return "INITIAL"
+	case WatchdogOkay:
+		return "OKAY"
+	case WatchdogSuspect:
+		return "SUSPECT"
+	case WatchdogDown:
+		return "DOWN"
+	case WatchdogReopen:
+		return "REOPEN"
+	}
+	return "UNKNOWN"
+}
+
+type watchdogAction int
+
+const (
+	watchdogSetTimer watchdogAction = 1 << iota
+	watchdogSendDWR
+	watchdogCloseConnection
+)
+
+// watchdog implements the state machine of RFC 3539 section 3.4.1. It only
+// decides what has to happen next; loopWatchdog owns the timer and performs
+// the returned actions.
+type watchdog struct {
+	mu      sync.Mutex
+	state   WatchdogState
+	pending bool
+	numDWA  int
+}
+
+func (w *watchdog) State() WatchdogState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+func (w *watchdog) connectionUp() watchdogAction {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.state {
+	case WatchdogInitial:
+		w.state = WatchdogOkay
+		return watchdogSetTimer
+	case WatchdogDown:
+		w.state = WatchdogReopen
+		w.numDWA = 0
+		w.pending = true
+		return watchdogSendDWR | watchdogSetTimer
+	}
+	return 0
+}
+
+func (w *watchdog) connectionDown() watchdogAction {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == WatchdogDown {
+		return 0
+	}
+	w.state = WatchdogDown
+	return watchdogSetTimer
+}
+
+func (w *watchdog) receiveDWA() watchdogAction {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.state {
+	case WatchdogOkay, WatchdogSuspect:
+		w.state = WatchdogOkay
+		w.pending = false
+		return watchdogSetTimer
+	case WatchdogReopen:
+		w.numDWA++
+		w.pending = false
+		if w.numDWA >= 3 {
+			w.state = WatchdogOkay
+		}
+		return watchdogSetTimer
+	}
+	return 0
+}
+
+func (w *watchdog) receiveTraffic() watchdogAction {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.state {
+	case WatchdogOkay, WatchdogSuspect:
+		w.state = WatchdogOkay
+		return watchdogSetTimer
+	}
+	return 0
+}
+
+func (w *watchdog) expire() watchdogAction {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch w.state {
+	case WatchdogOkay:
+		if w.pending {
+			w.state = WatchdogSuspect
+			return watchdogSetTimer
+		}
+		w.pending = true
+		return watchdogSendDWR | watchdogSetTimer
+	case WatchdogSuspect:
+		w.state = WatchdogDown
+		return watchdogCloseConnection | watchdogSetTimer
+	case WatchdogReopen:
+		if !w.pending {
+			w.pending = true
+			return watchdogSendDWR | watchdogSetTimer
+		}
+		if w.numDWA < 0 {
+			w.state = WatchdogDown
+			return watchdogCloseConnection | watchdogSetTimer
+		}
+		w.numDWA = -1
+		return watchdogSetTimer
+	case WatchdogDown:
+		return watchdogSetTimer
+	}
+	return 0
+}
+
+// watchdogTimeout returns Tw with the jitter of RFC 3539 section 3.4.1,
+// which is at most two seconds but never more than a quarter of Tw.
+func watchdogTimeout(interval time.Duration) time.Duration {
+	jitter := 2 * time.Second
+	if jitter > interval/4 {
+		jitter = interval / 4
+	}
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - jitter + time.Duration(rand.Int63n(int64(2*jitter)))
+}
@@ -0,0 +1,105 @@
+package dcc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+)
+
+func TestWatchdogSuspectThenDown(t *testing.T) {
+	w := &watchdog{}
+	w.connectionUp()
+
+	if action := w.expire(); action&watchdogSendDWR == 0 {
+		t.Error("expected a DWR on the first expiry")
+	}
+	if state := w.State(); state != WatchdogOkay {
+		t.Errorf("expected OKAY while the DWR is pending, got %s", state)
+	}
+
+	w.expire()
+	if state := w.State(); state != WatchdogSuspect {
+		t.Errorf("expected SUSPECT after a missed DWA, got %s", state)
+	}
+
+	if action := w.expire(); action&watchdogCloseConnection == 0 {
+		t.Error("expected the connection to be closed")
+	}
+	if state := w.State(); state != WatchdogDown {
+		t.Errorf("expected DOWN after two missed DWAs, got %s", state)
+	}
+}
+
+func TestWatchdogSuspectRecovers(t *testing.T) {
+	w := &watchdog{}
+	w.connectionUp()
+	w.expire()
+	w.expire()
+
+	w.receiveTraffic()
+	if state := w.State(); state != WatchdogOkay {
+		t.Errorf("expected OKAY after traffic, got %s", state)
+	}
+	if action := w.expire(); action&watchdogSendDWR != 0 {
+		t.Error("the DWR sent before SUSPECT is still pending")
+	}
+}
+
+func TestWatchdogReopenNeedsThreeDWA(t *testing.T) {
+	w := &watchdog{state: WatchdogDown}
+
+	if action := w.connectionUp(); action&watchdogSendDWR == 0 {
+		t.Error("expected a DWR when the connection reopens")
+	}
+	for i := 0; i < 3; i++ {
+		if state := w.State(); state != WatchdogReopen {
+			t.Fatalf("expected REOPEN after %d DWA, got %s", i, state)
+		}
+		w.receiveTraffic()
+		w.receiveDWA()
+		w.expire()
+	}
+	if state := w.State(); state != WatchdogOkay {
+		t.Errorf("expected OKAY after three DWA, got %s", state)
+	}
+}
+
+func TestWatchdogTimeoutJitter(t *testing.T) {
+	for _, interval := range []time.Duration{100 * time.Millisecond, 30 * time.Second} {
+		for i := 0; i < 100; i++ {
+			timeout := watchdogTimeout(interval)
+			if timeout < interval*3/4 || timeout > interval+2*time.Second {
+				t.Fatalf("timeout %s out of range for Tw %s", timeout, interval)
+			}
+		}
+	}
+}
+
+func TestBackgroundWatchdogDetectsPeerDown(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+	server.mux.Handle("DWR", diam.HandlerFunc(func(diam.Conn, *diam.Message) {}))
+
+	client := NewTestClient(server.Address)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []WatchdogState{WatchdogOkay, WatchdogSuspect, WatchdogDown}
+	for _, state := range expected {
+		select {
+		case s := <-client.StateNotify():
+			if s != state {
+				t.Fatalf("expected %s, got %s", state, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", state)
+		}
+	}
+}